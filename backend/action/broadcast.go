@@ -0,0 +1,102 @@
+package action
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+// ==================== Admin: Broadcast ====================
+
+func (r *Registry) broadcastsConfirm(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
+	lm, err := user.GetLastMessage()
+	rangeOption := 0
+	if err == nil && lm != nil {
+		rangeOption, _ = strconv.Atoi(lm.PlainContent())
+	}
+	segment := model.FindAudienceSegmentByPosition(rangeOption)
+	if segment == nil {
+		return validationError("配信対象が見つかりません")
+	}
+	// LINE は1回の配信で5件までしか送れない
+	if !r.broadcaster.FitsInPush(msg) {
+		if m := model.GetMessageByScope("over_post_capacity"); m != nil {
+			return m.GetContent()
+		}
+		return "メッセージが長すぎるため配信できません。短くしてもう一度送ってください。"
+	}
+	user.UpsertLastMessage(fmt.Sprintf("%d:&:%s", rangeOption, msg))
+	return msg + "\n\n" + nextMessage.ToFormattedText() + "\n\n送信対象：" + segmentLabel(segment)
+}
+
+// broadcastsTestSend pushes the broadcast prepared in broadcastsConfirm to
+// the admin, rendered exactly as recipients will get it, and shows the
+// confirmation again so the admin can go on to send or schedule it.
+func (r *Registry) broadcastsTestSend(user *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
+	lm, err := user.GetLastMessage()
+	if err != nil || lm == nil {
+		return validationError("配信内容が見つかりません")
+	}
+	parts := strings.SplitN(lm.PlainContent(), ":&:", 2)
+	if len(parts) != 2 {
+		return validationError("配信内容が見つかりません")
+	}
+	// 本番の配信と同じ形で管理者自身に送る。配信内容は残すので、このまま送信や予約に進める
+	if result := r.broadcaster.Unicast(user.LineUserID, parts[1]); !result.OK() {
+		log.Printf("Error test-sending broadcast to user %d: %v", user.ID, result.Err)
+		return validationError("テスト送信に失敗しました")
+	}
+	return nextMessage.ToFormattedText()
+}
+
+// broadcastsSegments lists the saved audience segments with their recipient
+// counts, for the admin to pick one by number.
+func broadcastsSegments(_ *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
+	segments, err := model.GetAudienceSegments()
+	if err != nil || len(segments) == 0 {
+		return validationError("配信対象が登録されていません")
+	}
+	lines := make([]string, 0, len(segments))
+	for i := range segments {
+		lines = append(lines, fmt.Sprintf("%d: %s", segments[i].Position, segmentLabel(&segments[i])))
+	}
+	return nextMessage.GetContent() + "\n\n" + strings.Join(lines, "\n")
+}
+
+// segmentLabel returns the segment name with its current recipient count.
+func segmentLabel(s *model.AudienceSegment) string {
+	count, err := s.CountRecipients()
+	if err != nil {
+		log.Printf("Error counting segment %s: %v", s.Name, err)
+		return s.Name
+	}
+	return fmt.Sprintf("%s（%d人）", s.Name, count)
+}
+
+// queueBroadcast writes the admin's broadcast to the outbox. Sends that
+// finally fail are recorded under the admin's broadcast failure group and the
+// admin is told, so they can resend them with "再送信".
+func queueBroadcast(user *model.User, segment *model.AudienceSegment, message string) error {
+	groupID := model.NewBroadcastFailureGroup(user.ID)
+	var msgs []*model.OutboxMessage
+	if segment.All {
+		msgs = append(msgs, model.NewOutboxBroadcast(groupID, message))
+	} else {
+		ids, err := segment.LineUserIDs()
+		if err != nil {
+			return err
+		}
+		msgs = model.NewOutboxMulticast(groupID, message, ids)
+	}
+	for _, m := range msgs {
+		m.NotifyLineUserID = user.LineUserID
+	}
+	if err := model.QueueOutboxMessages(nil, msgs...); err != nil {
+		return err
+	}
+	log.Printf("Broadcast by user %d to segment %s queued (%d requests, group %s)", user.ID, segment.Name, len(msgs), groupID)
+	return nil
+}
@@ -0,0 +1,162 @@
+package action
+
+import (
+	"strings"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/storage"
+	"github.com/RyokouKanai/gomethod/view"
+)
+
+// listDateFormat is how item dates are shown in lists.
+const listDateFormat = "2006年1月2日"
+
+// gMessagePreviewLength is how much of a g_message the text list shows.
+const gMessagePreviewLength = 30
+
+// newListView returns the list of records of the kind (see ListRecordID)
+// shown at listMessage, with a button for each option of the step that
+// follows picking an item (e.g. 編集 / 削除).
+func newListView(header string, listMessage *model.Message, kind string, items []view.Item) *view.List {
+	return &view.List{
+		Header:    header,
+		Items:     items,
+		Buttons:   itemButtons(listMessage),
+		MessageID: listMessage.ID,
+		Kind:      kind,
+	}
+}
+
+// listRecordIDs returns the IDs of the user's records of a list kind, in
+// the order the list numbers them.
+func listRecordIDs(user *model.User, kind string) ([]uint, bool) {
+	var ids []uint
+	switch kind {
+	case "dream_wishes":
+		wishes, _ := user.GetDreamWishes()
+		for _, w := range wishes {
+			ids = append(ids, w.ID)
+		}
+	case "solution_wishes":
+		wishes, _ := user.GetSolutionWishes()
+		for _, w := range wishes {
+			ids = append(ids, w.ID)
+		}
+	case "hates":
+		hates, _ := user.GetHates()
+		for _, h := range hates {
+			ids = append(ids, h.ID)
+		}
+	case "happiness":
+		happiness, _ := user.GetHappiness()
+		for _, h := range happiness {
+			ids = append(ids, h.ID)
+		}
+	default:
+		period, ok := strings.CutPrefix(kind, "g_messages:")
+		if !ok {
+			return nil, false
+		}
+		messages, _ := model.GetGMessagesByPeriod(period)
+		for _, m := range messages {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids, true
+}
+
+// ListRecordID returns the ID of the record now numbered number (1-based) in
+// the user's list of the kind. A list button compares it with the record it
+// was rendered for, so a stale list can't act on a different record.
+func (r *Registry) ListRecordID(user *model.User, kind string, number int) (uint, bool) {
+	ids, ok := listRecordIDs(user, kind)
+	if !ok || number < 1 || number > len(ids) {
+		return 0, false
+	}
+	return ids[number-1], true
+}
+
+// itemButtons follows the conversation from the list: the user types an item
+// number, and the next message offers what to do with it. A list that has
+// options of its own takes numbers as those options, so it gets no buttons.
+func itemButtons(listMessage *model.Message) []view.Button {
+	if options, _ := listMessage.GetOptions(); len(options) > 0 {
+		return nil
+	}
+	rp := model.FindFirstReplyPatternByMessage(listMessage.ID)
+	if rp == nil {
+		return nil
+	}
+	next := rp.GetNextMessage()
+	if next == nil {
+		return nil
+	}
+	options, _ := next.GetOptions()
+	buttons := make([]view.Button, 0, len(options))
+	for _, o := range options {
+		buttons = append(buttons, view.Button{Label: o.GetContent(), Option: o.Position})
+	}
+	return buttons
+}
+
+func wishItems(wishes []model.Wish) []view.Item {
+	items := make([]view.Item, 0, len(wishes))
+	for i, w := range wishes {
+		hasImg := "なし"
+		if w.GetS3ObjectURL() != "" {
+			hasImg = "あり"
+		}
+		items = append(items, view.Item{
+			Number:   i + 1,
+			RecordID: w.ID,
+			Date:     w.CreatedAt.Format(listDateFormat),
+			Content:  w.PlainContent(),
+			ImageURL: storage.URL(w.GetS3ObjectURL()),
+			Notes:    []string{"画像: " + hasImg},
+		})
+	}
+	return items
+}
+
+func hateItems(hates []model.Hate) []view.Item {
+	items := make([]view.Item, 0, len(hates))
+	for i, h := range hates {
+		items = append(items, view.Item{
+			Number:   i + 1,
+			RecordID: h.ID,
+			Date:     h.CreatedAt.Format(listDateFormat),
+			Content:  h.PlainContent(),
+		})
+	}
+	return items
+}
+
+func happinessItems(happiness []model.Happiness) []view.Item {
+	items := make([]view.Item, 0, len(happiness))
+	for i, h := range happiness {
+		item := view.Item{
+			Number:   i + 1,
+			RecordID: h.ID,
+			Date:     h.CreatedAt.Format(listDateFormat),
+			Content:  h.PlainContent(),
+		}
+		if h.GetAudioURL() != "" {
+			item.Notes = []string{"音声: あり"}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func gMessageItems(messages []model.GMessage) []view.Item {
+	items := make([]view.Item, 0, len(messages))
+	for i, m := range messages {
+		items = append(items, view.Item{
+			Number:   i + 1,
+			RecordID: m.ID,
+			Content:  m.PlainContent(),
+			Preview:  gMessagePreviewLength,
+		})
+	}
+	return items
+}
@@ -6,31 +6,40 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/delivery"
 	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/storage"
 )
 
-// Broadcaster is an interface for sending broadcast messages (avoids import cycle with service).
+// Broadcaster is an interface for sending messages right away (avoids import
+// cycle with service). Broadcasts themselves go through the outbox.
 type Broadcaster interface {
-	Broadcast(message string)
-	BroadcastToShik(message string, lineUserIDs []string)
+	Unicast(lineUserID, message string) delivery.Result
+	// FitsInPush reports whether the message can be sent in one push,
+	// multicast or broadcast request.
+	FitsInPush(message string) bool
 }
 
 // Registry maps execution_method names to action functions.
 type Registry struct {
 	actions     map[string]ActionFunc
+	durations   map[string]time.Duration
 	broadcaster Broadcaster
 }
 
 // ActionFunc is the function signature for all actions.
-// Returns the message content to reply with (string or []string).
+// Returns the message content to reply with (string, []string, or []map[string]string
+// of {"type": "text"|"image", "content": ...} for mixed text and images).
 type ActionFunc func(user *model.User, receivedMessage string, replyToken string, nextMessage *model.Message) interface{}
 
 // NewRegistry creates a new action registry with all actions registered.
 func NewRegistry(broadcaster Broadcaster) *Registry {
 	r := &Registry{
 		actions:     make(map[string]ActionFunc),
+		durations:   make(map[string]time.Duration),
 		broadcaster: broadcaster,
 	}
 	r.registerAll()
@@ -47,6 +56,12 @@ func (r *Registry) Execute(method string, user *model.User, receivedMessage stri
 	return fn(user, receivedMessage, replyToken, nextMessage)
 }
 
+// ExpectedDuration returns how long the action usually takes, or 0 for
+// actions that answer right away.
+func (r *Registry) ExpectedDuration(method string) time.Duration {
+	return r.durations[method]
+}
+
 func (r *Registry) registerAll() {
 	// User content actions
 	r.actions["dream_wishes_index"] = dreamWishesIndex
@@ -54,11 +69,13 @@ func (r *Registry) registerAll() {
 	r.actions["dream_wishes_edit"] = dreamWishesEdit
 	r.actions["dream_wishes_update"] = dreamWishesUpdate
 	r.actions["dream_wishes_destroy"] = dreamWishesDestroy
+	r.actions["dream_wishes_attach_image"] = dreamWishesAttachImage
 	r.actions["solution_wishes_index"] = solutionWishesIndex
 	r.actions["solution_wishes_create"] = solutionWishesCreate
 	r.actions["solution_wishes_edit"] = solutionWishesEdit
 	r.actions["solution_wishes_update"] = solutionWishesUpdate
 	r.actions["solution_wishes_destroy"] = solutionWishesDestroy
+	r.actions["solution_wishes_attach_image"] = solutionWishesAttachImage
 	r.actions["hates_index"] = hatesIndex
 	r.actions["hates_create"] = hatesCreate
 	r.actions["hates_edit"] = hatesEdit
@@ -68,6 +85,7 @@ func (r *Registry) registerAll() {
 	r.actions["happiness_index"] = happinessIndex
 	r.actions["happiness_create"] = happinessCreate
 	r.actions["happiness_destroy"] = happinessDestroy
+	r.actions["happiness_attach_audio"] = happinessAttachAudio
 	r.actions["talks_index"] = talksIndex
 	r.actions["g_messages_show"] = gMessagesShow
 	r.actions["thanks_count_show"] = thanksCountShow
@@ -82,7 +100,12 @@ func (r *Registry) registerAll() {
 	r.actions["save_selected_option"] = saveSelectedOption
 
 	// Admin actions
-	r.actions["broadcasts_confirm"] = broadcastsConfirm
+	r.actions["broadcasts_segments"] = broadcastsSegments
+	r.actions["broadcasts_confirm"] = r.broadcastsConfirm
+	r.actions["broadcasts_test_send"] = r.broadcastsTestSend
+	r.actions["broadcasts_schedule"] = broadcastsSchedule
+	r.actions["broadcasts_scheduled_index"] = broadcastsScheduledIndex
+	r.actions["broadcasts_scheduled_cancel"] = broadcastsScheduledCancel
 	r.actions["broadcasts"] = func(user *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
 		lm, err := user.GetLastMessage()
 		if err != nil || lm == nil {
@@ -95,15 +118,14 @@ func (r *Registry) registerAll() {
 		rangeOption, _ := strconv.Atoi(parts[0])
 		sentMessage := parts[1]
 
-		if getRangeName(rangeOption) == "シックのみ" {
-			shikUsers, _ := model.GetShikUsers()
-			var ids []string
-			for _, u := range shikUsers {
-				ids = append(ids, u.LineUserID)
-			}
-			r.broadcaster.BroadcastToShik(sentMessage, ids)
-		} else {
-			r.broadcaster.Broadcast(sentMessage)
+		segment := model.FindAudienceSegmentByPosition(rangeOption)
+		if segment == nil {
+			return validationError("配信対象が見つかりません")
+		}
+
+		if err := queueBroadcast(user, segment, sentMessage); err != nil {
+			log.Printf("Error queueing broadcast by user %d to segment %s: %v", user.ID, segment.Name, err)
+			return validationError("配信の登録に失敗しました")
 		}
 		return nextMessage.GetContent()
 	}
@@ -132,6 +154,10 @@ func (r *Registry) registerAll() {
 	r.actions["notices_destroy"] = noticesDestroy
 	r.actions["notices_edit"] = noticesEdit
 	r.actions["notices_update"] = noticesUpdate
+
+	// Slow actions: the chat shows a loading animation while they run
+	r.durations["experiences_show"] = 3 * time.Second
+	r.durations["g_messages_show"] = 2 * time.Second
 }
 
 // Helper: selected number from last_message (0-indexed)
@@ -147,6 +173,22 @@ func selectedNumber(user *model.User) int {
 	return n - 1
 }
 
+// Helper: whether the received message is a reference to content the user
+// sent, as saved by ContentService. Typed text never is.
+func isUserContent(user *model.User, msg string) bool {
+	key, ok := storage.KeyOf(msg)
+	return ok && strings.HasPrefix(key, storage.UserKeyPrefix(user.ID))
+}
+
+// Helper: validation error message with a fallback text
+func validationError(fallback string) string {
+	msg := model.GetMessageByScope("validation_error")
+	if msg != nil {
+		return msg.GetContent()
+	}
+	return fallback
+}
+
 // Helper: save user's selection
 func saveSelectedOption(user *model.User, receivedMessage string, _ string, nextMessage *model.Message) interface{} {
 	if err := user.UpsertLastMessage(receivedMessage); err != nil {
@@ -170,8 +212,7 @@ func dreamWishesIndex(user *model.User, _ string, _ string, nextMessage *model.M
 		}
 		return "願いがまだ登録されていません"
 	}
-	base := nextMessage.ToFormattedText()
-	return base + "\n\n" + formatWishes(wishes)
+	return newListView(nextMessage.ToFormattedText(), nextMessage, "dream_wishes", wishItems(wishes))
 }
 
 func dreamWishesCreate(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
@@ -185,7 +226,7 @@ func dreamWishesEdit(user *model.User, _ string, _ string, nextMessage *model.Me
 	if idx < 0 || idx >= len(wishes) {
 		return nextMessage.GetContent()
 	}
-	return nextMessage.GetContent() + "\n\n選択中の願い:\n" + wishes[idx].PlainContent()
+	return wishDetail(nextMessage.GetContent()+"\n\n選択中の願い:\n", wishes[idx])
 }
 
 func dreamWishesUpdate(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
@@ -217,6 +258,10 @@ func dreamWishesDestroy(user *model.User, _ string, _ string, nextMessage *model
 	return nextMessage.GetContent() + "\n\n" + plain
 }
 
+func dreamWishesAttachImage(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
+	return attachWishImage(user, "dream", msg, nextMessage)
+}
+
 // ==================== Solution Wishes ====================
 
 func solutionWishesIndex(user *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
@@ -228,8 +273,7 @@ func solutionWishesIndex(user *model.User, _ string, _ string, nextMessage *mode
 		}
 		return "願いがまだ登録されていません"
 	}
-	base := nextMessage.ToFormattedText()
-	return base + "\n\n" + formatWishes(wishes)
+	return newListView(nextMessage.ToFormattedText(), nextMessage, "solution_wishes", wishItems(wishes))
 }
 
 func solutionWishesCreate(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
@@ -243,7 +287,7 @@ func solutionWishesEdit(user *model.User, _ string, _ string, nextMessage *model
 	if idx < 0 || idx >= len(wishes) {
 		return nextMessage.GetContent()
 	}
-	return nextMessage.GetContent() + "\n\n選択中の願い:\n" + wishes[idx].PlainContent()
+	return wishDetail(nextMessage.GetContent()+"\n\n選択中の願い:\n", wishes[idx])
 }
 
 func solutionWishesUpdate(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
@@ -275,6 +319,36 @@ func solutionWishesDestroy(user *model.User, _ string, _ string, nextMessage *mo
 	return nextMessage.GetContent() + "\n\n" + plain
 }
 
+func solutionWishesAttachImage(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
+	return attachWishImage(user, "solution", msg, nextMessage)
+}
+
+// attachWishImage links an uploaded image to the user's most recent wish of the given type.
+// The reply pattern must accept "image" input so the received message is the stored image.
+func attachWishImage(user *model.User, wishType, imageRef string, nextMessage *model.Message) interface{} {
+	if !isUserContent(user, imageRef) {
+		return validationError("画像を送ってください")
+	}
+	w := model.FindLatestWish(user.ID, wishType)
+	if w == nil {
+		return nextMessage.GetContent()
+	}
+	model.UpdateWishS3URL(w.ID, imageRef)
+	return nextMessage.ToFormattedText()
+}
+
+// wishDetail shows a wish as text, followed by its image if one is attached.
+func wishDetail(header string, w model.Wish) interface{} {
+	text := header + w.PlainContent()
+	if w.GetS3ObjectURL() == "" {
+		return text
+	}
+	return []map[string]string{
+		{"type": "text", "content": text},
+		{"type": "image", "content": storage.URL(w.GetS3ObjectURL())},
+	}
+}
+
 // ==================== Hates ====================
 
 func hatesIndex(user *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
@@ -282,8 +356,7 @@ func hatesIndex(user *model.User, _ string, _ string, nextMessage *model.Message
 	if len(hates) == 0 {
 		return "まだ嫌だー！を投企してないようです。。"
 	}
-	base := nextMessage.ToFormattedText()
-	return base + "\n\n" + formatHates(hates)
+	return newListView(nextMessage.ToFormattedText(), nextMessage, "hates", hateItems(hates))
 }
 
 func hatesCreate(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
@@ -341,8 +414,7 @@ func happinessIndex(user *model.User, _ string, _ string, nextMessage *model.Mes
 	if len(happiness) == 0 {
 		return "まだ良かったー！を書いてないようだね。これからどんどん書いていこう！"
 	}
-	base := nextMessage.ToFormattedText()
-	return base + "\n\n" + formatHappiness(happiness)
+	return newListView(nextMessage.ToFormattedText(), nextMessage, "happiness", happinessItems(happiness))
 }
 
 func happinessCreate(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
@@ -365,6 +437,20 @@ func happinessDestroy(user *model.User, _ string, _ string, nextMessage *model.M
 	return nextMessage.GetContent() + "\n\n" + plain
 }
 
+// happinessAttachAudio links a voice note to the user's most recent happiness.
+// The reply pattern must accept "audio" input so the received message is the stored audio.
+func happinessAttachAudio(user *model.User, audioRef string, _ string, nextMessage *model.Message) interface{} {
+	if !isUserContent(user, audioRef) {
+		return validationError("音声メッセージを送ってください")
+	}
+	h := model.FindLatestHappiness(user.ID)
+	if h == nil {
+		return nextMessage.GetContent()
+	}
+	model.UpdateHappinessAudioURL(h.ID, audioRef)
+	return nextMessage.ToFormattedText()
+}
+
 func talksIndex(_ *model.User, _ string, _ string, _ *model.Message) interface{} {
 	badResp := model.GetMessageByScope("bad_talk_response")
 	if badResp != nil {
@@ -524,33 +610,6 @@ func feelingSettingUpdate(user *model.User, msg string, _ string, nextMessage *m
 }
 
 
-// ==================== Admin: Broadcast ====================
-
-func broadcastsConfirm(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
-	lm, err := user.GetLastMessage()
-	rangeOption := 0
-	if err == nil && lm != nil {
-		rangeOption, _ = strconv.Atoi(lm.PlainContent())
-	}
-	user.UpsertLastMessage(fmt.Sprintf("%d:&:%s", rangeOption, msg))
-	rangeName := getRangeName(rangeOption)
-	return msg + "\n\n" + nextMessage.ToFormattedText() + "\n\n送信対象：" + rangeName
-}
-
-
-
-func getRangeName(position int) string {
-	broadcastRangeMsg := model.GetMessageByScope("select_broadcast_range")
-	if broadcastRangeMsg == nil {
-		return ""
-	}
-	o := model.FindOptionByMessageAndPosition(broadcastRangeMsg.ID, position)
-	if o == nil {
-		return ""
-	}
-	return o.GetContent()
-}
-
 // ==================== Admin: GMessages CRUD ====================
 
 func gMessagesCRUD(period string) (
@@ -562,7 +621,7 @@ func gMessagesCRUD(period string) (
 	}
 	index = func(_ *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
 		messages, _ := model.GetGMessagesByPeriod(period)
-		return nextMessage.GetContent() + "\n\n" + formatGMessages(messages)
+		return newListView(nextMessage.GetContent(), nextMessage, "g_messages:"+period, gMessageItems(messages))
 	}
 	destroy = func(user *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
 		messages, _ := model.GetGMessagesByPeriod(period)
@@ -628,37 +687,6 @@ var (
 
 // ==================== Formatters ====================
 
-func formatWishes(wishes []model.Wish) string {
-	var lines []string
-	for i, w := range wishes {
-		hasImg := "なし"
-		if w.GetS3ObjectURL() != "" {
-			hasImg = "あり"
-		}
-		lines = append(lines, fmt.Sprintf("%d:\n日付: %s\n内容: %s\n画像: %s",
-			i+1, w.CreatedAt.Format("2006年1月2日"), w.PlainContent(), hasImg))
-	}
-	return strings.Join(lines, "\n\n")
-}
-
-func formatHates(hates []model.Hate) string {
-	var lines []string
-	for i, h := range hates {
-		lines = append(lines, fmt.Sprintf("%d:\n日付: %s\n内容: %s",
-			i+1, h.CreatedAt.Format("2006年1月2日"), h.PlainContent()))
-	}
-	return strings.Join(lines, "\n\n")
-}
-
-func formatHappiness(happiness []model.Happiness) string {
-	var lines []string
-	for i, h := range happiness {
-		lines = append(lines, fmt.Sprintf("%d:\n日付: %s\n内容: %s",
-			i+1, h.CreatedAt.Format("2006年1月2日"), h.PlainContent()))
-	}
-	return strings.Join(lines, "\n\n")
-}
-
 func formatFeelingSettings(settings []model.FeelingSetting) string {
 	var lines []string
 	for _, s := range settings {
@@ -667,14 +695,3 @@ func formatFeelingSettings(settings []model.FeelingSetting) string {
 	return strings.Join(lines, "\n")
 }
 
-func formatGMessages(messages []model.GMessage) string {
-	var lines []string
-	for i, m := range messages {
-		plain := m.PlainContent()
-		if len([]rune(plain)) > 30 {
-			plain = string([]rune(plain)[:30]) + "..."
-		}
-		lines = append(lines, fmt.Sprintf("%d:\n%s", i+1, plain))
-	}
-	return strings.Join(lines, "\n\n")
-}
@@ -0,0 +1,166 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+// ==================== Admin: Scheduled Broadcasts ====================
+
+// sendAtLayouts are the send time formats an admin can enter, in Asia/Tokyo.
+var sendAtLayouts = []string{
+	"2006-01-02 15:04",
+	"2006/1/2 15:04",
+	"1/2 15:04",
+	"15:04",
+}
+
+var weekdays = []string{"日", "月", "火", "水", "木", "金", "土"}
+
+// broadcastsSchedule stores the broadcast prepared in broadcastsConfirm to be
+// sent at the time the admin entered, instead of sending it now.
+func broadcastsSchedule(user *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
+	lm, err := user.GetLastMessage()
+	if err != nil || lm == nil {
+		return validationError("配信内容が見つかりません")
+	}
+	parts := strings.SplitN(lm.PlainContent(), ":&:", 2)
+	if len(parts) != 2 {
+		return validationError("配信内容が見つかりません")
+	}
+	rangeOption, _ := strconv.Atoi(parts[0])
+	segment := model.FindAudienceSegmentByPosition(rangeOption)
+	if segment == nil {
+		return validationError("配信対象が見つかりません")
+	}
+
+	sendAt, err := parseSendAt(msg, time.Now())
+	if err != nil {
+		return validationError("送信日時は「10/18 8:00」のように、これから先の日時で入力してください")
+	}
+	if _, err := model.CreateScheduledBroadcast(user.ID, segment.ID, parts[1], sendAt); err != nil {
+		return validationError("送信予約に失敗しました")
+	}
+	return fmt.Sprintf("%s\n\n%s に「%s」へ送信します", nextMessage.GetContent(), formatSendAt(sendAt), segment.Name)
+}
+
+// broadcastsScheduledIndex lists the pending broadcasts numbered by their
+// IDs, which the admin enters to cancel one.
+func broadcastsScheduledIndex(_ *model.User, _ string, _ string, nextMessage *model.Message) interface{} {
+	broadcasts, _ := model.GetPendingScheduledBroadcasts()
+	if len(broadcasts) == 0 {
+		return "送信予約はありません"
+	}
+	return nextMessage.GetContent() + "\n\n" + formatScheduledBroadcasts(broadcasts)
+}
+
+// broadcastsScheduledCancel cancels the broadcast whose number the admin
+// entered. The number is the broadcast's ID, so a list that has changed
+// since it was shown can't cancel a different broadcast.
+func broadcastsScheduledCancel(_ *model.User, msg string, _ string, nextMessage *model.Message) interface{} {
+	id, err := strconv.ParseUint(strings.TrimSpace(normalizeDigits(msg)), 10, 64)
+	if err != nil {
+		return validationError("キャンセルする予約の番号を入力してください")
+	}
+	sb := model.FindScheduledBroadcastByID(uint(id))
+	if sb == nil {
+		return validationError("この番号の送信予約はありません")
+	}
+	switch sb.Status {
+	case model.ScheduledBroadcastPending:
+	case model.ScheduledBroadcastCancelled:
+		return validationError("この送信予約はすでにキャンセルされています")
+	default:
+		return validationError("この配信はすでに送信されたためキャンセルできません")
+	}
+	ok, err := sb.Cancel()
+	if err != nil || !ok {
+		// 一覧を見ている間に送信が始まった
+		return validationError("この配信はすでに送信されたためキャンセルできません")
+	}
+	plain, _ := sb.PlainMessage()
+	return nextMessage.GetContent() + "\n\n" + formatSendAt(sb.SendAt) + "\n" + plain
+}
+
+// parseSendAt parses a send time entered by an admin. Dates without a year
+// and times without a date refer to the next such time after now.
+func parseSendAt(text string, now time.Time) (time.Time, error) {
+	text = strings.TrimSpace(normalizeDigits(text))
+	now = now.In(model.Tokyo)
+
+	day, layouts := 0, sendAtLayouts
+	// 「明日」は時刻だけと組み合わせる
+	if rest := strings.TrimPrefix(text, "明日"); rest != text {
+		text, day, layouts = strings.TrimSpace(rest), 1, []string{"15:04"}
+	}
+
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, text, model.Tokyo)
+		if err != nil {
+			continue
+		}
+		switch layout {
+		case "15:04":
+			t = time.Date(now.Year(), now.Month(), now.Day()+day, t.Hour(), t.Minute(), 0, 0, model.Tokyo)
+			if day == 0 && !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+		case "1/2 15:04":
+			t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, model.Tokyo)
+			if !t.After(now) {
+				t = t.AddDate(1, 0, 0)
+			}
+		}
+		if !t.After(now) {
+			return time.Time{}, errors.New("send time is in the past")
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse send time %q", text)
+}
+
+// normalizeDigits converts full-width digits and punctuation to ASCII, as
+// Japanese keyboards often enter them.
+func normalizeDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '０' && r <= '９':
+			return r - '０' + '0'
+		case r == '：':
+			return ':'
+		case r == '／':
+			return '/'
+		case r == '－':
+			return '-'
+		case r == '　':
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+func formatSendAt(t time.Time) string {
+	t = t.In(model.Tokyo)
+	return fmt.Sprintf("%d月%d日(%s) %s", t.Month(), t.Day(), weekdays[t.Weekday()], t.Format("15:04"))
+}
+
+func formatScheduledBroadcasts(broadcasts []model.ScheduledBroadcast) string {
+	var lines []string
+	for _, sb := range broadcasts {
+		target := ""
+		if segment := model.FindAudienceSegmentByID(sb.SegmentID); segment != nil {
+			target = " " + segment.Name
+		}
+		plain, _ := sb.PlainMessage()
+		if len([]rune(plain)) > 30 {
+			plain = string([]rune(plain)[:30]) + "..."
+		}
+		lines = append(lines, fmt.Sprintf("%d: %s%s\n%s", sb.ID, formatSendAt(sb.SendAt), target, plain))
+	}
+	return strings.Join(lines, "\n\n")
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// GoogleJWKSURL is where Google publishes the keys that sign its ID tokens.
+const GoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// KeySource looks up RSA public keys by key ID.
+type KeySource interface {
+	PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+// jwk is a single JSON Web Key (only the RSA fields are used).
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS parses a JSON Web Key Set into RSA public keys by key ID.
+func ParseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid modulus: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid exponent: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// StaticKeySource serves a fixed key set, e.g. a local JWKS file for tests.
+type StaticKeySource struct {
+	keys map[string]*rsa.PublicKey
+}
+
+// NewStaticKeySource creates a key source from JWKS JSON.
+func NewStaticKeySource(data []byte) (*StaticKeySource, error) {
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticKeySource{keys: keys}, nil
+}
+
+// NewFileKeySource creates a key source from a JWKS file.
+func NewFileKeySource(path string) (*StaticKeySource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewStaticKeySource(data)
+}
+
+func (s *StaticKeySource) PublicKey(_ context.Context, kid string) (*rsa.PublicKey, error) {
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+	return key, nil
+}
+
+// RemoteKeySource fetches a JWKS over HTTP and caches it. An unknown key ID
+// triggers a refetch (rate-limited), so key rotation is picked up.
+type RemoteKeySource struct {
+	URL    string
+	TTL    time.Duration
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewRemoteKeySource creates a key source for the JWKS at url.
+func NewRemoteKeySource(url string) *RemoteKeySource {
+	return &RemoteKeySource{
+		URL:    url,
+		TTL:    time.Hour,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *RemoteKeySource) PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := time.Since(s.fetchedAt) > s.TTL
+	if key, ok := s.keys[kid]; ok && !expired {
+		return key, nil
+	}
+	// 未知の kid による連続フェッチを避ける
+	if expired || time.Since(s.fetchedAt) > time.Minute {
+		if err := s.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+	return key, nil
+}
+
+func (s *RemoteKeySource) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching JWKS: status %d", resp.StatusCode)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(raw)
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GoogleIssuers are the issuers of Google-signed ID tokens.
+var GoogleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// clockSkew is the leeway allowed when checking token times.
+const clockSkew = time.Minute
+
+// Claims are the ID token claims used for authorization.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+}
+
+// Identity returns a human-readable caller identity for logs.
+func (c *Claims) Identity() string {
+	if c.Email != "" {
+		return c.Email
+	}
+	return c.Subject
+}
+
+// audience accepts both the string and array forms of "aud".
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Verifier checks RS256-signed OIDC ID tokens.
+type Verifier struct {
+	Keys     KeySource
+	Audience string
+	Issuers  []string
+	// AllowedEmails restricts callers to these (verified) emails when not empty.
+	AllowedEmails []string
+}
+
+// Verify validates the token's signature, issuer, audience and lifetime and
+// returns its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported algorithm: %s", header.Alg)
+	}
+
+	key, err := v.Keys.PublicKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	claims, err := UnverifiedClaims(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return claims, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) checkClaims(c *Claims) error {
+	now := time.Now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(clockSkew)) {
+		return errors.New("token expired")
+	}
+	if c.IssuedAt != 0 && now.Add(clockSkew).Before(time.Unix(c.IssuedAt, 0)) {
+		return errors.New("token issued in the future")
+	}
+	if !contains(v.Issuers, c.Issuer) {
+		return fmt.Errorf("unexpected issuer: %s", c.Issuer)
+	}
+	if v.Audience == "" || !contains(c.Audience, v.Audience) {
+		return fmt.Errorf("unexpected audience: %v", []string(c.Audience))
+	}
+	if len(v.AllowedEmails) > 0 && (!c.EmailVerified || !contains(v.AllowedEmails, c.Email)) {
+		return fmt.Errorf("caller not allowed: %s", c.Email)
+	}
+	return nil
+}
+
+// UnverifiedClaims decodes the token's claims without checking the signature.
+// Only use the result for logging.
+func UnverifiedClaims(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	return &claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
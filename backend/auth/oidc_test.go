@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKid      = "test-key"
+	testAudience = "https://gomethod.example/batch"
+	testIssuer   = "https://accounts.google.com"
+	testEmail    = "scheduler@gomethod.iam.gserviceaccount.com"
+)
+
+var testKey = mustGenerateKey()
+
+func mustGenerateKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// testJWKS returns the JWKS of testKey under testKid.
+func testJWKS(t *testing.T) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kid": testKid,
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(testKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(testKey.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sign makes a token with the header and claims, signed by testKey.
+func sign(t *testing.T, header, claims map[string]interface{}) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validHeader() map[string]interface{} {
+	return map[string]interface{}{"alg": "RS256", "kid": testKid, "typ": "JWT"}
+}
+
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            testIssuer,
+		"sub":            "1234567890",
+		"aud":            testAudience,
+		"email":          testEmail,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys, err := NewStaticKeySource(testJWKS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{Keys: keys, Audience: testAudience, Issuers: GoogleIssuers, AllowedEmails: []string{testEmail}}
+
+	with := func(key string, value interface{}) map[string]interface{} {
+		c := validClaims()
+		c[key] = value
+		return c
+	}
+	header := func(key string, value interface{}) map[string]interface{} {
+		h := validHeader()
+		h[key] = value
+		return h
+	}
+	valid := sign(t, validHeader(), validClaims())
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "valid", token: valid},
+		{name: "audience list", token: sign(t, validHeader(), with("aud", []string{"other", testAudience}))},
+		{name: "tampered claims", token: parts[0] + "." + strings.Split(sign(t, validHeader(), with("email", "evil@example.com")), ".")[1] + "." + parts[2], wantErr: "invalid signature"},
+		{name: "tampered signature", token: parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("not a signature")), wantErr: "invalid signature"},
+		{name: "alg HS256", token: sign(t, header("alg", "HS256"), validClaims()), wantErr: "unsupported algorithm"},
+		{name: "alg none", token: sign(t, header("alg", "none"), validClaims()), wantErr: "unsupported algorithm"},
+		{name: "unknown kid", token: sign(t, header("kid", "other-key"), validClaims()), wantErr: "unknown key id"},
+		{name: "wrong audience", token: sign(t, validHeader(), with("aud", "https://other.example")), wantErr: "unexpected audience"},
+		{name: "wrong issuer", token: sign(t, validHeader(), with("iss", "https://evil.example")), wantErr: "unexpected issuer"},
+		{name: "expired", token: sign(t, validHeader(), with("exp", time.Now().Add(-time.Hour).Unix())), wantErr: "token expired"},
+		{name: "no expiry", token: sign(t, validHeader(), with("exp", 0)), wantErr: "token expired"},
+		{name: "not yet valid", token: sign(t, validHeader(), with("iat", time.Now().Add(time.Hour).Unix())), wantErr: "issued in the future"},
+		{name: "email not allowed", token: sign(t, validHeader(), with("email", "someone@example.com")), wantErr: "caller not allowed"},
+		{name: "email unverified", token: sign(t, validHeader(), with("email_verified", false)), wantErr: "caller not allowed"},
+		{name: "malformed", token: "not-a-token", wantErr: "malformed token"},
+		{name: "bad header", token: "!!!." + parts[1] + "." + parts[2], wantErr: "invalid header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify() error = %v, want nil", err)
+				}
+				if claims.Identity() != testEmail {
+					t.Errorf("Identity() = %q, want %q", claims.Identity(), testEmail)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutAllowList(t *testing.T) {
+	keys, err := NewStaticKeySource(testJWKS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{Keys: keys, Audience: testAudience, Issuers: GoogleIssuers}
+	c := validClaims()
+	c["email"] = "anyone@example.com"
+	c["email_verified"] = false
+	if _, err := v.Verify(context.Background(), sign(t, validHeader(), c)); err != nil {
+		t.Errorf("Verify() error = %v, want nil without an allow list", err)
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	keys, err := ParseJWKS(testJWKS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := keys[testKid]
+	if !ok {
+		t.Fatalf("key %s not parsed", testKid)
+	}
+	if key.N.Cmp(testKey.N) != 0 || key.E != testKey.E {
+		t.Errorf("parsed key differs from the signing key")
+	}
+
+	if _, err := ParseJWKS([]byte(`{"keys":[{"kid":"k","kty":"RSA","n":"***","e":"AQAB"}]}`)); err == nil {
+		t.Error("ParseJWKS accepted an invalid modulus")
+	}
+	keys, err = ParseJWKS([]byte(`{"keys":[{"kid":"ec","kty":"EC"}]}`))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("ParseJWKS(EC key) = %v, %v; want no keys", keys, err)
+	}
+}
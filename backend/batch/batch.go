@@ -1,22 +1,94 @@
 package batch
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
+	"github.com/RyokouKanai/gomethod/database"
 	"github.com/RyokouKanai/gomethod/model"
 	"github.com/RyokouKanai/gomethod/service"
+	"gorm.io/gorm"
 )
 
+// Job is a named batch. Name is the key used for deduplication and in the run ledger.
+type Job struct {
+	Name string
+	Fn   func(b *Base) error
+	// Repeatable jobs run many times a day, so they skip the daily dedup claim.
+	Repeatable bool
+}
+
+// Registered batch jobs.
+var (
+	SendDailyGMessage       = Job{Name: "SendDailyGMessage", Fn: sendDailyGMessage}
+	SendWeeklyGMessage      = Job{Name: "SendWeeklyGMessage", Fn: sendWeeklyGMessage}
+	SendWeeklyBlogGMessage  = Job{Name: "SendWeeklyBlogGMessage", Fn: sendWeeklyBlogGMessage}
+	SendExperienceGMessage  = Job{Name: "SendExperienceGMessage", Fn: sendExperienceGMessage}
+	SendMoonMessageToday    = Job{Name: "SendMoonMessageToday", Fn: sendMoonMessageToday}
+	SendMoonMessageTomorrow = Job{Name: "SendMoonMessageTomorrow", Fn: sendMoonMessageTomorrow}
+	SendNotice              = Job{Name: "SendNotice", Fn: sendNotice}
+	PurgeWebhookEvents      = Job{Name: "PurgeWebhookEvents", Fn: purgeWebhookEvents}
+	SendScheduledBroadcasts = Job{Name: "SendScheduledBroadcasts", Fn: sendScheduledBroadcasts, Repeatable: true}
+	SyncRichMenuLinks       = Job{Name: "SyncRichMenuLinks", Fn: syncRichMenuLinks, Repeatable: true}
+)
+
+// ErrDryRunUnsupported is returned by jobs that cannot be previewed.
+var ErrDryRunUnsupported = errors.New("batch does not support dry run")
+
 // Base provides common batch functionality.
 type Base struct {
 	Name          string
 	ExecutionTime float64
+	Run           *model.BatchRun
+
+	// Date is the day the batch runs for.
+	Date time.Time
+
+	// Force runs the batch even if it already ran on Date.
+	Force bool
+	// Repeatable skips the daily dedup claim; see Job.
+	Repeatable bool
+
+	// DryRun collects what would be sent into Preview instead of sending it.
+	DryRun  bool
+	Preview *Preview
+
+	ctx context.Context
+}
+
+// Preview is the result of a dry run.
+type Preview struct {
+	Batch        string   `json:"batch"`
+	Date         string   `json:"date"`
+	AudienceSize int64    `json:"audience_size"`
+	Messages     []string `json:"messages"`
+	// RandomPick is true when one of Messages is chosen at random on the real run.
+	RandomPick bool `json:"random_pick"`
+}
+
+// Context is cancelled when the batch has to stop, e.g. the instance is
+// shutting down and the drain deadline has passed.
+func (b *Base) Context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
 }
 
-// IsDuplicate checks if this batch was already executed today.
-func (b *Base) IsDuplicate() bool {
-	return model.CheckBatchDuplicateExecution(b.Name)
+// claim takes the batch's run date so the batch runs at most once a day.
+// It returns false if the batch already ran that day, unless Force is set.
+func (b *Base) claim() (bool, error) {
+	if b.Repeatable {
+		return true, nil
+	}
+	if b.Force {
+		log.Printf("Batch %s forced to run for %s", b.Name, model.BatchRunDate(b.Date).Format("2006-01-02"))
+		return true, model.ForceBatchExecution(b.Name, b.Date)
+	}
+	return model.ClaimBatchExecution(b.Name, b.Date)
 }
 
 // PrintResult logs the execution result.
@@ -29,210 +101,344 @@ DONE: %s
 `, b.Name, b.ExecutionTime)
 }
 
-// Broadcast sends a message to all users.
-func (b *Base) Broadcast(message string) {
-	service.NewSendService().Broadcast(message)
+// Broadcast queues a message to all users in the outbox. Sends that finally
+// fail are recorded against the run so they can be resent.
+func (b *Base) Broadcast(message string) error {
+	return b.BroadcastTx(nil, message)
 }
 
-// Unicast sends a message to a specific user.
-func (b *Base) Unicast(lineUserID, message string) {
-	service.NewSendService().Unicast(lineUserID, message)
+// BroadcastTx is Broadcast within the given transaction, so the message is
+// queued only if the state change it belongs to is committed.
+func (b *Base) BroadcastTx(tx *gorm.DB, message string) error {
+	if err := b.Context().Err(); err != nil {
+		return err
+	}
+	if b.DryRun {
+		return b.previewBroadcast(message)
+	}
+	if err := model.QueueOutboxMessages(tx, model.NewOutboxBroadcast(b.source(), message)); err != nil {
+		return fmt.Errorf("queueing broadcast: %w", err)
+	}
+	// LINE のブロードキャストは友だち全員に届くため、ブロックしていないユーザー数を宛先数とする
+	count, err := model.CountFollowingUsers()
+	if err != nil {
+		log.Printf("Error counting recipients: %v", err)
+	}
+	b.addQueued(int(count), service.PushMessageCount(message))
+	return nil
 }
 
-// RunBatch executes a batch with timing and dedup checks.
-func RunBatch(name string, fn func()) {
-	base := &Base{Name: name}
-	if base.IsDuplicate() {
-		log.Printf("Batch %s already executed today, skipping", name)
-		return
+// Unicast queues a message to a specific user in the outbox.
+func (b *Base) Unicast(lineUserID, message string) error {
+	// ループ中にシャットダウンされた場合はそこで打ち切る
+	if err := b.Context().Err(); err != nil {
+		return err
 	}
+	if b.DryRun {
+		b.Preview.AudienceSize++
+		b.Preview.Messages = append(b.Preview.Messages, message)
+		return nil
+	}
+	if err := model.QueueOutboxMessages(nil, model.NewOutboxPush(b.source(), lineUserID, message)); err != nil {
+		return fmt.Errorf("queueing push to %s: %w", lineUserID, err)
+	}
+	b.addQueued(1, service.PushMessageCount(message))
+	return nil
+}
 
-	start := time.Now()
-	fn()
-	base.ExecutionTime = time.Since(start).Seconds()
-	base.PrintResult()
+// Multicast queues a message to the given users in the outbox, one
+// multicast per chunk of recipients.
+func (b *Base) Multicast(lineUserIDs []string, message string) error {
+	if err := b.Context().Err(); err != nil {
+		return err
+	}
+	if b.DryRun {
+		b.Preview.AudienceSize += int64(len(lineUserIDs))
+		b.Preview.Messages = append(b.Preview.Messages, message)
+		return nil
+	}
+	if err := model.QueueOutboxMessages(nil, model.NewOutboxMulticast(b.source(), message, lineUserIDs)...); err != nil {
+		return fmt.Errorf("queueing multicast: %w", err)
+	}
+	b.addQueued(len(lineUserIDs), service.PushMessageCount(message))
+	return nil
 }
 
-// SendDailyGMessage sends the daily G message to all users.
-func SendDailyGMessage() {
-	RunBatch("SendDailyGMessage", func() {
-		masterUser, err := model.GetMasterUser()
-		if err != nil {
-			log.Printf("Error getting master user: %v", err)
-			return
-		}
-		gMsg, err := masterUser.FetchGMessageByPeriod("daily")
-		if err != nil {
-			log.Printf("Error fetching daily g_message: %v", err)
-			return
-		}
-		masterUser.CreateGMessageHistory(gMsg)
+// source is the outbox source of the batch's messages: the run ID, which is
+// also the send failure group of the run.
+func (b *Base) source() string {
+	if b.Run == nil {
+		return b.Name
+	}
+	return b.Run.RunID
+}
 
-		todaysMsg := model.GetMessageByScope("todays_g_message")
-		content := ""
-		if todaysMsg != nil {
-			content = todaysMsg.GetContent()
-		}
-		message := content + "\n\n" + gMsg.PlainContent()
+// previewBroadcast records a broadcast message and its audience in the preview.
+func (b *Base) previewBroadcast(message string) error {
+	count, err := model.CountFollowingUsers()
+	if err != nil {
+		return fmt.Errorf("counting recipients: %w", err)
+	}
+	b.Preview.AudienceSize = count
+	b.Preview.Messages = append(b.Preview.Messages, message)
+	return nil
+}
 
-		base := &Base{}
-		base.Broadcast(message)
-	})
+// addQueued adds to the run's counts of recipients and messages queued in
+// the outbox. Whether they were delivered is counted by the outbox.
+func (b *Base) addQueued(recipients, messagesPerRecipient int) {
+	if b.Run == nil {
+		return
+	}
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	b.Run.RecipientCount += recipients
+	b.Run.MessageCount += recipients * messagesPerRecipient
 }
 
-// SendWeeklyGMessage sends the weekly G message (Saturday video).
-func SendWeeklyGMessage() {
-	RunBatch("SendWeeklyGMessage", func() {
-		masterUser, err := model.GetMasterUser()
-		if err != nil {
-			log.Printf("Error getting master user: %v", err)
-			return
-		}
-		gMsg, err := masterUser.FetchGMessageByPeriod("weekly")
-		if err != nil {
-			log.Printf("Error fetching weekly g_message: %v", err)
-			return
-		}
-		masterUser.CreateGMessageHistory(gMsg)
+// DryRun runs the job for the given date without sending anything and returns
+// what it would have sent. Dedup checks, the run ledger and g_message
+// histories are left untouched.
+func DryRun(job Job, date time.Time) (*Preview, error) {
+	b := &Base{
+		Name:   job.Name,
+		Date:   date,
+		DryRun: true,
+		Preview: &Preview{
+			Batch:    job.Name,
+			Date:     model.BatchRunDate(date).Format("2006-01-02"),
+			Messages: []string{},
+		},
+	}
+	if err := job.Fn(b); err != nil {
+		return nil, err
+	}
+	return b.Preview, nil
+}
 
-		todaysMsg := model.GetMessageByScope("todays_weekly_g_message")
-		content := ""
-		if todaysMsg != nil {
-			content = todaysMsg.GetContent()
+// RunBatch executes a batch with timing and dedup checks, recording the
+// outcome in the run ledger when the batch has a run.
+func RunBatch(b *Base, fn func(b *Base) error) {
+	if b.Date.IsZero() {
+		b.Date = time.Now()
+	}
+	claimed, err := b.claim()
+	if err != nil {
+		log.Printf("Error claiming batch %s: %v", b.Name, err)
+		b.finish(model.BatchRunFailed, err)
+		return
+	}
+	if !claimed {
+		log.Printf("Batch %s already executed today, skipping", b.Name)
+		b.finish(model.BatchRunSkipped, nil)
+		return
+	}
+
+	start := time.Now()
+	status := model.BatchRunFailed
+	var runErr error
+	defer func() {
+		if r := recover(); r != nil {
+			runErr = fmt.Errorf("panic: %v", r)
 		}
-		message := content + "\n\n" + gMsg.PlainContent()
+		b.ExecutionTime = time.Since(start).Seconds()
+		b.PrintResult()
+		b.finish(status, runErr)
+	}()
 
-		base := &Base{}
-		base.Broadcast(message)
-	})
+	runErr = fn(b)
+	if runErr != nil {
+		log.Printf("Batch %s failed: %v", b.Name, runErr)
+		return
+	}
+	status = model.BatchRunSucceeded
 }
 
-// SendWeeklyBlogGMessage sends the weekly blog message (Sunday).
-func SendWeeklyBlogGMessage() {
-	RunBatch("SendWeeklyBlogGMessage", func() {
-		masterUser, err := model.GetMasterUser()
-		if err != nil {
-			log.Printf("Error getting master user: %v", err)
-			return
-		}
-		gMsg, err := masterUser.FetchGMessageByPeriod("weekly_blog")
-		if err != nil {
-			log.Printf("Error fetching weekly_blog g_message: %v", err)
-			return
-		}
-		masterUser.CreateGMessageHistory(gMsg)
+func (b *Base) finish(status string, runErr error) {
+	// シャットダウン時に interrupted として記録済みなら上書きしない
+	if b.Run == nil || !untrack(b) {
+		return
+	}
+	if err := b.Run.Finish(status, runErr); err != nil {
+		log.Printf("Error recording batch run %s: %v", b.Run.RunID, err)
+	}
+}
 
-		todaysMsg := model.GetMessageByScope("todays_weekly_blog_g_message")
-		content := ""
-		if todaysMsg != nil {
-			content = todaysMsg.GetContent()
-		}
-		message := content + "\n\n" + gMsg.PlainContent()
+// sendGMessage broadcasts a random unsent g_message of the period, prefixed
+// with the message of the given scope.
+func sendGMessage(b *Base, period, scope string) error {
+	masterUser, err := model.GetMasterUser()
+	if err != nil {
+		return fmt.Errorf("getting master user: %w", err)
+	}
 
-		base := &Base{}
-		base.Broadcast(message)
-	})
-}
+	prefix := ""
+	if todaysMsg := model.GetMessageByScope(scope); todaysMsg != nil {
+		prefix = todaysMsg.GetContent()
+	}
 
-// SendExperienceGMessage sends experience messages (Tue/Thu).
-func SendExperienceGMessage() {
-	RunBatch("SendExperienceGMessage", func() {
-		masterUser, err := model.GetMasterUser()
+	if b.DryRun {
+		// 実際の送信では候補からランダムに選ばれるため、候補をすべて返す
+		candidates, err := masterUser.PeekGMessagesByPeriod(period)
 		if err != nil {
-			log.Printf("Error getting master user: %v", err)
-			return
+			return fmt.Errorf("fetching %s g_message: %w", period, err)
 		}
-		gMsg, err := masterUser.FetchGMessageByPeriod("experience")
-		if err != nil {
-			log.Printf("Error fetching experience g_message: %v", err)
-			return
+		b.Preview.RandomPick = len(candidates) > 1
+		for i := range candidates {
+			if err := b.Broadcast(prefix + "\n\n" + candidates[i].PlainContent()); err != nil {
+				return err
+			}
 		}
-		masterUser.CreateGMessageHistory(gMsg)
+		return nil
+	}
 
-		todaysMsg := model.GetMessageByScope("todays_experience_g_message")
-		content := ""
-		if todaysMsg != nil {
-			content = todaysMsg.GetContent()
+	gMsg, err := masterUser.FetchGMessageByPeriod(period)
+	if err != nil {
+		return fmt.Errorf("fetching %s g_message: %w", period, err)
+	}
+	// 履歴と配信を同じトランザクションで書き、片方だけ残らないようにする
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := masterUser.CreateGMessageHistoryTx(tx, gMsg); err != nil {
+			return fmt.Errorf("recording g_message history: %w", err)
 		}
-		message := content + "\n\n" + gMsg.PlainContent()
-
-		base := &Base{}
-		base.Broadcast(message)
+		return b.BroadcastTx(tx, prefix+"\n\n"+gMsg.PlainContent())
 	})
 }
 
-// SendMoonMessageToday sends moon phase messages on the day of new/full moon.
-func SendMoonMessageToday() {
-	RunBatch("SendMoonMessageToday", func() {
-		mp := model.GetMoonPhaseToday()
-		if mp == nil {
-			return
-		}
+// sendDailyGMessage sends the daily G message to all users.
+func sendDailyGMessage(b *Base) error {
+	return sendGMessage(b, "daily", "todays_g_message")
+}
 
-		var scope string
-		switch mp.Phase {
-		case "new":
-			scope = "new_moon_today"
-		case "full":
-			scope = "full_moon_today"
-		default:
-			return
-		}
+// sendWeeklyGMessage sends the weekly G message (Saturday video).
+func sendWeeklyGMessage(b *Base) error {
+	return sendGMessage(b, "weekly", "todays_weekly_g_message")
+}
 
-		msg := model.GetMessageByScope(scope)
-		if msg == nil {
-			return
-		}
+// sendWeeklyBlogGMessage sends the weekly blog message (Sunday).
+func sendWeeklyBlogGMessage(b *Base) error {
+	return sendGMessage(b, "weekly_blog", "todays_weekly_blog_g_message")
+}
 
-		base := &Base{}
-		base.Broadcast(msg.GetContent())
-	})
+// sendExperienceGMessage sends experience messages (Tue/Thu).
+func sendExperienceGMessage(b *Base) error {
+	return sendGMessage(b, "experience", "todays_experience_g_message")
 }
 
-// SendMoonMessageTomorrow sends moon phase messages the day before new/full moon.
-func SendMoonMessageTomorrow() {
-	RunBatch("SendMoonMessageTomorrow", func() {
-		mp := model.GetMoonPhaseTomorrow()
-		if mp == nil {
-			return
-		}
+// sendMoonMessageToday sends moon phase messages on the day of new/full moon.
+func sendMoonMessageToday(b *Base) error {
+	mp := model.GetMoonPhaseOn(b.Date)
+	if mp == nil {
+		return nil
+	}
 
-		var scope string
-		switch mp.Phase {
-		case "new":
-			scope = "new_moon_tomorrow"
-		case "full":
-			scope = "full_moon_tomorrow"
-		default:
-			return
-		}
+	var scope string
+	switch mp.Phase {
+	case "new":
+		scope = "new_moon_today"
+	case "full":
+		scope = "full_moon_today"
+	default:
+		return nil
+	}
 
-		msg := model.GetMessageByScope(scope)
-		if msg == nil {
-			return
-		}
+	msg := model.GetMessageByScope(scope)
+	if msg == nil {
+		return fmt.Errorf("message scope %s not found", scope)
+	}
+	return b.Broadcast(msg.GetContent())
+}
 
-		base := &Base{}
-		base.Broadcast(msg.GetContent())
-	})
+// sendMoonMessageTomorrow sends moon phase messages the day before new/full moon.
+func sendMoonMessageTomorrow(b *Base) error {
+	mp := model.GetMoonPhaseOn(b.Date.AddDate(0, 0, 1))
+	if mp == nil {
+		return nil
+	}
+
+	var scope string
+	switch mp.Phase {
+	case "new":
+		scope = "new_moon_tomorrow"
+	case "full":
+		scope = "full_moon_tomorrow"
+	default:
+		return nil
+	}
+
+	msg := model.GetMessageByScope(scope)
+	if msg == nil {
+		return fmt.Errorf("message scope %s not found", scope)
+	}
+	return b.Broadcast(msg.GetContent())
 }
 
-// SendNotice sends periodic notices (1st and 15th of month).
-func SendNotice() {
-	RunBatch("SendNotice", func() {
-		masterUser, err := model.GetMasterUser()
+// sendNotice sends periodic notices (1st and 15th of month).
+func sendNotice(b *Base) error {
+	masterUser, err := model.GetMasterUser()
+	if err != nil {
+		return fmt.Errorf("getting master user: %w", err)
+	}
+	if b.DryRun {
+		candidates, err := masterUser.PeekGMessagesByPeriod("notice")
 		if err != nil {
-			log.Printf("Error getting master user: %v", err)
-			return
+			return fmt.Errorf("fetching notice: %w", err)
 		}
-		notice, err := masterUser.FetchGMessageByPeriod("notice")
-		if err != nil {
-			log.Printf("Error fetching notice: %v", err)
-			return
+		b.Preview.RandomPick = len(candidates) > 1
+		for i := range candidates {
+			if err := b.Broadcast(candidates[i].PlainContent()); err != nil {
+				return err
+			}
 		}
-		masterUser.CreateGMessageHistory(notice)
+		return nil
+	}
 
-		base := &Base{}
-		base.Broadcast(notice.PlainContent())
+	notice, err := masterUser.FetchGMessageByPeriod("notice")
+	if err != nil {
+		return fmt.Errorf("fetching notice: %w", err)
+	}
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := masterUser.CreateGMessageHistoryTx(tx, notice); err != nil {
+			return fmt.Errorf("recording notice history: %w", err)
+		}
+		return b.BroadcastTx(tx, notice.PlainContent())
 	})
 }
+
+// webhookEventRetention is how long webhook event IDs are kept. LINE only
+// redelivers for a limited time, so older IDs are no longer needed.
+const webhookEventRetention = 7 * 24 * time.Hour
+
+// outboxRetention is how long sent and given-up outbox messages are kept for
+// /batch/outbox. Given-up sends stay resendable as send failures.
+const outboxRetention = 7 * 24 * time.Hour
+
+// purgeWebhookEvents deletes webhook events past the retention window,
+// including ones that never finished, reply continuations that can no
+// longer be read, and finished outbox messages.
+func purgeWebhookEvents(b *Base) error {
+	if b.DryRun {
+		return ErrDryRunUnsupported
+	}
+	finished, unfinished, err := model.PurgeWebhookEvents(time.Now().Add(-webhookEventRetention))
+	if err != nil {
+		return err
+	}
+	log.Printf("Purged %d webhook events", finished)
+	if unfinished > 0 {
+		log.Printf("Dropped %d webhook events that never finished", unfinished)
+	}
+
+	n, err := model.PurgeReplyContinuations(time.Now().Add(-model.ReplyContinuationTTL))
+	if err != nil {
+		return err
+	}
+	log.Printf("Purged %d reply continuations", n)
+
+	n, err = model.PurgeOutboxMessages(time.Now().Add(-outboxRetention))
+	if err != nil {
+		return err
+	}
+	log.Printf("Purged %d outbox messages", n)
+	return nil
+}
@@ -0,0 +1,21 @@
+package batch
+
+// Registry maps the batch names used in URLs and schedules to jobs.
+var Registry = map[string]Job{
+	"send_daily_g_message":       SendDailyGMessage,
+	"send_weekly_g_message":      SendWeeklyGMessage,
+	"send_weekly_blog_g_message": SendWeeklyBlogGMessage,
+	"send_experience_g_message":  SendExperienceGMessage,
+	"send_moon_message_today":    SendMoonMessageToday,
+	"send_moon_message_tomorrow": SendMoonMessageTomorrow,
+	"send_notice":                SendNotice,
+	"purge_webhook_events":       PurgeWebhookEvents,
+	"send_scheduled_broadcasts":  SendScheduledBroadcasts,
+	"sync_rich_menu_links":       SyncRichMenuLinks,
+}
+
+// Lookup returns the job registered under name.
+func Lookup(name string) (Job, bool) {
+	job, ok := Registry[name]
+	return job, ok
+}
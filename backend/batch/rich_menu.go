@@ -0,0 +1,26 @@
+package batch
+
+import (
+	"log"
+
+	"github.com/RyokouKanai/gomethod/service"
+)
+
+// syncRichMenuLinks relinks users whose rich menu no longer matches their
+// member type, plan or shik status. Users are relinked as soon as they talk
+// to the bot; this catches the ones changed elsewhere who stay silent.
+func syncRichMenuLinks(b *Base) error {
+	if b.DryRun {
+		return ErrDryRunUnsupported
+	}
+	rms, err := service.NewRichMenuService()
+	if err != nil {
+		return err
+	}
+	n, err := rms.LinkAll(b.Context())
+	if err != nil {
+		return err
+	}
+	log.Printf("Relinked rich menus of %d users", n)
+	return nil
+}
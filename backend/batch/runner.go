@@ -0,0 +1,101 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+// ErrShuttingDown is returned by Start once Shutdown has been called.
+var ErrShuttingDown = errors.New("batch: shutting down")
+
+// 実行中のバッチ。シャットダウン時に完了を待ち、間に合わなければ中断として記録する
+var (
+	runningMu sync.Mutex
+	running   = map[*Base]context.CancelFunc{}
+	runningWG sync.WaitGroup
+	closing   bool
+)
+
+// Start records a new run of the job and executes it in the background.
+// The returned run can be looked up later to see the outcome. With force the
+// job runs even if it already ran today.
+func Start(job Job, force bool) (*model.BatchRun, error) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if closing {
+		return nil, ErrShuttingDown
+	}
+
+	run, err := model.CreateBatchRun(job.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Base{Name: job.Name, Run: run, Date: time.Now(), Force: force, Repeatable: job.Repeatable, ctx: ctx}
+	running[b] = cancel
+	runningWG.Add(1)
+	go func() {
+		defer runningWG.Done()
+		defer cancel()
+		RunBatch(b, job.Fn)
+	}()
+	return run, nil
+}
+
+// Shutdown stops accepting batches and waits for running ones to finish.
+// Batches still running when ctx is done are cancelled and recorded as
+// interrupted in the run ledger.
+func Shutdown(ctx context.Context) error {
+	runningMu.Lock()
+	closing = true
+	runningMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		runningWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	runningMu.Lock()
+	interrupted := make([]model.BatchRun, 0, len(running))
+	for b, cancel := range running {
+		cancel()
+		interrupted = append(interrupted, *b.Run)
+	}
+	running = map[*Base]context.CancelFunc{}
+	runningMu.Unlock()
+
+	for i := range interrupted {
+		r := &interrupted[i]
+		log.Printf("Batch %s (run %s) interrupted by shutdown: %d recipients queued so far",
+			r.Name, r.RunID, r.RecipientCount)
+		if err := r.Finish(model.BatchRunInterrupted, errors.New("interrupted by shutdown")); err != nil {
+			log.Printf("Error recording batch run %s: %v", r.RunID, err)
+		}
+	}
+	return ctx.Err()
+}
+
+// untrack removes a finished batch from the running set. It returns false if
+// the batch was already recorded as interrupted by Shutdown.
+func untrack(b *Base) bool {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if _, ok := running[b]; !ok {
+		return false
+	}
+	delete(running, b)
+	return true
+}
@@ -0,0 +1,143 @@
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/service"
+	"gorm.io/gorm"
+)
+
+// sendScheduledBroadcasts queues the admin broadcasts whose send time has come
+// in the outbox. Sends that finally fail are recorded under the admin's
+// broadcast failure group, so the admin can resend them from the chat with
+// "再送信" like a direct broadcast.
+func sendScheduledBroadcasts(b *Base) error {
+	if b.DryRun {
+		return previewScheduledBroadcasts(b)
+	}
+
+	due, err := model.GetDueScheduledBroadcasts(time.Now())
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for i := range due {
+		if err := b.Context().Err(); err != nil {
+			return err
+		}
+		sb := &due[i]
+		err := sendScheduledBroadcast(b, sb)
+		if errors.Is(err, errNotClaimed) {
+			continue // キャンセルされたか、他の実行が送信済み
+		}
+		if err != nil {
+			log.Printf("Error queueing scheduled broadcast %d: %v", sb.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scheduled broadcasts failed", failed, len(due))
+	}
+	return nil
+}
+
+// errNotClaimed is returned by sendScheduledBroadcast when the broadcast was
+// cancelled or taken by another run.
+var errNotClaimed = errors.New("scheduled broadcast already taken")
+
+// sendScheduledBroadcast claims the broadcast, queues it and marks it sent in
+// one transaction, so it is neither lost, stuck nor queued twice.
+func sendScheduledBroadcast(b *Base, sb *model.ScheduledBroadcast) error {
+	segment := model.FindAudienceSegmentByID(sb.SegmentID)
+	if segment == nil {
+		sb.Fail()
+		return fmt.Errorf("segment %d not found", sb.SegmentID)
+	}
+	message, err := sb.PlainMessage()
+	if err != nil {
+		sb.Fail()
+		return fmt.Errorf("decrypting message: %w", err)
+	}
+
+	groupID := model.NewBroadcastFailureGroup(sb.AdminID)
+	var msgs []*model.OutboxMessage
+	var recipients int
+	if segment.All {
+		msgs = append(msgs, model.NewOutboxBroadcast(groupID, message))
+		count, _ := segment.CountRecipients()
+		recipients = int(count)
+	} else {
+		ids, err := segment.LineUserIDs()
+		if err != nil {
+			sb.Fail()
+			return err
+		}
+		msgs = model.NewOutboxMulticast(groupID, message, ids)
+		recipients = len(ids)
+	}
+	if admin := model.FindUserByID(sb.AdminID); admin != nil {
+		for _, m := range msgs {
+			m.NotifyLineUserID = admin.LineUserID
+		}
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		ok, err := sb.ClaimTx(tx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNotClaimed
+		}
+		if err := model.QueueOutboxMessages(tx, msgs...); err != nil {
+			return err
+		}
+		return sb.FinishTx(tx, model.ScheduledBroadcastSent, recipients, 0)
+	})
+	if errors.Is(err, errNotClaimed) {
+		return err
+	}
+	if err != nil {
+		sb.Fail()
+		return err
+	}
+	b.addQueued(recipients, service.PushMessageCount(message))
+	log.Printf("Scheduled broadcast %d to segment %s queued for %d recipients", sb.ID, segment.Name, recipients)
+	return nil
+}
+
+// previewScheduledBroadcasts shows the pending broadcasts due on the run date.
+func previewScheduledBroadcasts(b *Base) error {
+	pending, err := model.GetPendingScheduledBroadcasts()
+	if err != nil {
+		return err
+	}
+	day := model.BatchRunDate(b.Date)
+	for _, sb := range pending {
+		if !model.BatchRunDate(sb.SendAt).Equal(day) {
+			continue
+		}
+		segment := model.FindAudienceSegmentByID(sb.SegmentID)
+		if segment == nil {
+			continue
+		}
+		count, err := segment.CountRecipients()
+		if err != nil {
+			return err
+		}
+		message, err := sb.PlainMessage()
+		if err != nil {
+			return err
+		}
+		b.Preview.AudienceSize += count
+		b.Preview.Messages = append(b.Preview.Messages,
+			fmt.Sprintf("[%s %s]\n%s", sb.SendAt.In(model.Tokyo).Format("15:04"), segment.Name, message))
+	}
+	return nil
+}
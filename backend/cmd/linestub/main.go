@@ -0,0 +1,30 @@
+// Command linestub runs a local stand-in for the LINE Messaging API.
+//
+//	go run ./cmd/linestub -addr :8090
+//	LINE_API_ENDPOINT=http://localhost:8090 LINE_API_DATA_ENDPOINT=http://localhost:8090 \
+//	LINE_CHANNEL_TOKEN=dummy go run ./cmd/main.go
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/RyokouKanai/gomethod/linestub"
+)
+
+func main() {
+	addr := flag.String("addr", ":8090", "listen address")
+	flag.Parse()
+
+	stub := linestub.NewServer()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+		stub.ServeHTTP(w, r)
+	})
+
+	log.Printf("LINE API stub listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		log.Fatalf("Failed to start stub: %v", err)
+	}
+}
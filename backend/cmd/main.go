@@ -1,17 +1,34 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/RyokouKanai/gomethod/batch"
 	"github.com/RyokouKanai/gomethod/database"
 	"github.com/RyokouKanai/gomethod/handler"
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/scheduler"
+	"github.com/RyokouKanai/gomethod/service"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
 	// データベース接続
 	database.Connect()
+	if err := model.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	// コードが使うメッセージスコープがすべて存在するメッセージを指しているか
+	if err := model.CheckMessageScopes(); err != nil {
+		log.Fatalf("Invalid message scopes: %v", err)
+	}
 
 	// Gin ルーター設定
 	if os.Getenv("GIN_MODE") == "release" {
@@ -24,23 +41,78 @@ func main() {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// 保存した画像などを署名付き URL で配信（バケットは非公開）
+	r.GET("/blobs/*key", handler.BlobHandler)
+
 	// LINE Webhook
+	handler.StartWebhookWorkers()
 	r.POST("/callback", handler.WebhookHandler)
 
 	// バッチ実行エンドポイント（Cloud Scheduler から OIDC 認証で呼び出し）
-	batchGroup := r.Group("/batch")
+	batchGroup := r.Group("/batch", handler.BatchAuthMiddleware())
 	{
 		batchGroup.POST("/:name", handler.BatchHandler)
+		batchGroup.GET("/runs", handler.BatchRunsHandler)
+		batchGroup.GET("/runs/:id", handler.BatchRunHandler)
+		batchGroup.POST("/runs/:id/resend", handler.BatchResendHandler)
+		batchGroup.GET("/outbox", handler.OutboxHandler)
+		batchGroup.GET("/outbox/:id", handler.OutboxMessageHandler)
+		batchGroup.GET("/reply_fallbacks", handler.ReplyFallbacksHandler)
+		batchGroup.GET("/message_scopes", handler.MessageScopesHandler)
+		batchGroup.PUT("/message_scopes/:name", handler.UpdateMessageScopeHandler)
+		batchGroup.GET("/audience_segments", handler.AudienceSegmentsHandler)
+		batchGroup.POST("/audience_segments", handler.CreateAudienceSegmentHandler)
+		batchGroup.DELETE("/audience_segments/:id", handler.DeleteAudienceSegmentHandler)
+		// キューなどの内部メトリクス（expvar）
+		batchGroup.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 	}
 
+	// アウトボックスに書かれた push / multicast / broadcast を LINE に送る
+	service.StartOutboxDispatcher()
+
 	// ポート設定（Cloud Run は PORT 環境変数を使用）
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("Starting server on :%s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Starting server on :%s", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// ローカル・ステージング用: Cloud Scheduler の代わりにプロセス内でバッチを定期実行
+	if scheduler.Enabled() {
+		go scheduler.Run(ctx)
+	}
+
+	<-ctx.Done()
+	log.Println("Shutting down server")
+
+	// Cloud Run は SIGTERM から 10 秒で強制終了するため、その前に切り上げる
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	// 受付を止めた後、処理中の Webhook とバッチを同じ期限まで待つ
+	if err := handler.ShutdownWebhookWorkers(shutdownCtx); err != nil {
+		log.Printf("Webhook queue not drained: %v", err)
+	}
+	if err := batch.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Batches not drained: %v", err)
+	}
+	// バッチが書き終えた後に止める。送信中のものは次のインスタンスが拾い直す
+	if err := service.ShutdownOutboxDispatcher(shutdownCtx); err != nil {
+		log.Printf("Outbox dispatcher not stopped: %v", err)
 	}
+	log.Println("Server stopped")
 }
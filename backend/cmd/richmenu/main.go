@@ -0,0 +1,48 @@
+// Command richmenu uploads the rich menus in config/rich_menus.json to LINE
+// and links every user to the menu for their member type.
+//
+//	go run ./cmd/richmenu -dry-run  # 変更されるメニューを表示するだけ
+//	go run ./cmd/richmenu
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/service"
+)
+
+func main() {
+	file := flag.String("file", "config/rich_menus.json", "rich menu definitions")
+	dryRun := flag.Bool("dry-run", false, "show what would change without calling LINE")
+	flag.Parse()
+
+	configs, err := service.LoadRichMenuConfig(*file)
+	if err != nil {
+		log.Fatalf("Failed to load rich menus: %v", err)
+	}
+
+	database.Connect()
+	if err := model.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate: %v", err)
+	}
+
+	rms, err := service.NewRichMenuService()
+	if err != nil {
+		log.Fatalf("Failed to create LINE client: %v", err)
+	}
+	result, err := rms.Sync(context.Background(), configs, *dryRun)
+	if result != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	}
+	if err != nil {
+		log.Fatalf("Failed to sync rich menus: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+// Command schedule prints the next fire times of the batch schedules.
+//
+//	go run ./cmd/schedule                                    # batch_schedules テーブルから
+//	go run ./cmd/schedule -file config/batch_schedules.json  # 設定ファイルから
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/scheduler"
+)
+
+func main() {
+	file := flag.String("file", os.Getenv("BATCH_SCHEDULE_FILE"), "JSON schedule file (default: batch_schedules table)")
+	count := flag.Int("n", 5, "number of fire times to print per batch")
+	flag.Parse()
+
+	var entries []scheduler.Entry
+	var err error
+	if *file != "" {
+		entries, err = scheduler.LoadFile(*file)
+	} else {
+		database.Connect()
+		entries, err = scheduler.LoadEntries()
+	}
+	if err != nil {
+		log.Fatalf("Failed to load schedules: %v", err)
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		fmt.Printf("%s\t%s\t%s\n", e.Name, e.Cron, e.Schedule.Location)
+		t := now
+		for i := 0; i < *count; i++ {
+			t = e.Schedule.Next(t)
+			if t.IsZero() {
+				break
+			}
+			fmt.Printf("\t%s\n", t.Format("2006-01-02 (Mon) 15:04 MST"))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Command scopes shows and reassigns the message scopes.
+//
+//	go run ./cmd/scopes                   # 一覧
+//	go run ./cmd/scopes -check            # 必要なスコープがすべて解決できるか
+//	go run ./cmd/scopes -set default=110  # スコープを別のメッセージに付け替える
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+func main() {
+	check := flag.Bool("check", false, "check that every required scope points to an existing message")
+	set := flag.String("set", "", "reassign a scope, as name=message_id")
+	flag.Parse()
+
+	database.Connect()
+	if err := model.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate: %v", err)
+	}
+
+	switch {
+	case *set != "":
+		name, id, ok := strings.Cut(*set, "=")
+		messageID, err := strconv.ParseUint(id, 10, 64)
+		if !ok || err != nil {
+			log.Fatalf("-set must be name=message_id, got %q", *set)
+		}
+		scope, err := model.SetMessageScope(name, uint(messageID))
+		if err != nil {
+			log.Fatalf("Failed to set scope: %v", err)
+		}
+		fmt.Printf("%s\t%d\n", scope.Name, scope.MessageID)
+	case *check:
+		if err := model.CheckMessageScopes(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+	default:
+		scopes, err := model.GetMessageScopes()
+		if err != nil {
+			log.Fatalf("Failed to list scopes: %v", err)
+		}
+		for _, s := range scopes {
+			fmt.Printf("%s\t%d\t%s\n", s.Name, s.MessageID, s.UpdatedAt.Format("2006-01-02 15:04"))
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Command segments shows, creates and deletes the audience segments admins
+// pick from when broadcasting. A created segment is added to the chat's
+// segment picker (the select_broadcast_range message) as a new option.
+//
+//	go run ./cmd/segments                                         # 一覧（宛先数つき）
+//	go run ./cmd/segments -create '{"name":"有料会員","plan_ids":"2,3"}'
+//	go run ./cmd/segments -delete 3                               # ID で削除
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+func main() {
+	create := flag.String("create", "", "create a segment from its JSON filters")
+	del := flag.Uint("delete", 0, "delete the segment with this ID")
+	flag.Parse()
+
+	database.Connect()
+	if err := model.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate: %v", err)
+	}
+
+	switch {
+	case *create != "":
+		var s model.AudienceSegment
+		if err := json.Unmarshal([]byte(*create), &s); err != nil {
+			log.Fatalf("-create must be a segment as JSON: %v", err)
+		}
+		if err := model.CreateAudienceSegment(&s); err != nil {
+			log.Fatalf("Failed to create segment: %v", err)
+		}
+		fmt.Printf("%d\t%d\t%s\n", s.ID, s.Position, s.Name)
+	case *del != 0:
+		if err := model.DeleteAudienceSegment(*del); err != nil {
+			log.Fatalf("Failed to delete segment %d: %v", *del, err)
+		}
+		fmt.Println("deleted")
+	default:
+		segments, err := model.GetAudienceSegments()
+		if err != nil {
+			log.Fatalf("Failed to list segments: %v", err)
+		}
+		for i := range segments {
+			count, err := segments[i].CountRecipients()
+			if err != nil {
+				log.Printf("Failed to count %s: %v", segments[i].Name, err)
+			}
+			fmt.Printf("%d\t%d\t%s\t%d\n", segments[i].ID, segments[i].Position, segments[i].Name, count)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Package delivery holds the results of sending messages through LINE.
+// It has no dependencies so both the service and action packages can use it.
+package delivery
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// Kinds of send request.
+const (
+	KindPush      = "push"
+	KindMulticast = "multicast"
+	KindBroadcast = "broadcast"
+)
+
+// Result is the outcome of sending to one recipient. Recipients of the same
+// multicast request share the request's retry key, request ID and error.
+type Result struct {
+	Kind string `json:"kind"`
+	// To is the LINE user ID, or empty for a broadcast to all friends.
+	To string `json:"to,omitempty"`
+	// RetryKey is the X-Line-Retry-Key sent with the request. Resending with
+	// the same key lets LINE drop the message if it was accepted after all.
+	RetryKey   string `json:"retry_key,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Err        error  `json:"-"`
+}
+
+// OK reports whether LINE accepted the message.
+func (r Result) OK() bool {
+	return r.Err == nil
+}
+
+// Report collects the results of sending one message to many recipients.
+type Report struct {
+	Results []Result
+}
+
+// Add appends a result to the report.
+func (r *Report) Add(res Result) {
+	r.Results = append(r.Results, res)
+}
+
+// Sent returns the number of accepted requests.
+func (r *Report) Sent() int {
+	n := 0
+	for _, res := range r.Results {
+		if res.OK() {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the results LINE did not accept.
+func (r *Report) Failed() []Result {
+	var failed []Result
+	for _, res := range r.Results {
+		if !res.OK() {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Err summarises the failures, or returns nil if everything was sent.
+func (r *Report) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(failed))
+	for _, f := range failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", f.To, f.Err))
+	}
+	return fmt.Errorf("%d of %d sends failed: %s", len(failed), len(r.Results), strings.Join(msgs, "; "))
+}
+
+// NewRetryKey returns a random UUID (v4) for the X-Line-Retry-Key header.
+func NewRetryKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
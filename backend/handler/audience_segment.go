@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AudienceSegmentsHandler lists the audience segments with their current
+// recipient counts, in the order admins pick them in the chat.
+// GET /batch/audience_segments
+func AudienceSegmentsHandler(c *gin.Context) {
+	segments, err := model.GetAudienceSegments()
+	if err != nil {
+		log.Printf("Error listing audience segments: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot list audience segments"})
+		return
+	}
+	list := make([]gin.H, 0, len(segments))
+	for i := range segments {
+		count, err := segments[i].CountRecipients()
+		if err != nil {
+			log.Printf("Error counting segment %s: %v", segments[i].Name, err)
+		}
+		list = append(list, gin.H{"segment": segments[i], "recipients": count})
+	}
+	c.JSON(http.StatusOK, gin.H{"segments": list})
+}
+
+// CreateAudienceSegmentHandler saves a segment and adds it to the chat's
+// segment picker. The position is assigned after the existing segments.
+// POST /batch/audience_segments {"name": "有料会員", "plan_ids": "2,3"}
+func CreateAudienceSegmentHandler(c *gin.Context) {
+	var s model.AudienceSegment
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid segment"})
+		return
+	}
+	if err := model.CreateAudienceSegment(&s); err != nil {
+		log.Printf("Error creating audience segment %s: %v", s.Name, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Audience segment %s created at position %d by %s", s.Name, s.Position, c.GetString("batch_caller"))
+	c.JSON(http.StatusCreated, s)
+}
+
+// DeleteAudienceSegmentHandler deletes a segment and its option in the chat.
+// DELETE /batch/audience_segments/:id
+func DeleteAudienceSegmentHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	switch err := model.DeleteAudienceSegment(uint(id)); {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "audience segment not found"})
+	case errors.Is(err, model.ErrSegmentInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		log.Printf("Error deleting audience segment %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot delete audience segment"})
+	default:
+		log.Printf("Audience segment %d deleted by %s", id, c.GetString("batch_caller"))
+		c.Status(http.StatusNoContent)
+	}
+}
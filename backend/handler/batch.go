@@ -1,37 +1,144 @@
 package handler
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/RyokouKanai/gomethod/batch"
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/service"
 	"github.com/gin-gonic/gin"
 )
 
-// バッチ名とバッチ関数のマッピング
-var batchRegistry = map[string]func(){
-	"send_daily_g_message":       batch.SendDailyGMessage,
-	"send_weekly_g_message":      batch.SendWeeklyGMessage,
-	"send_weekly_blog_g_message": batch.SendWeeklyBlogGMessage,
-	"send_experience_g_message":  batch.SendExperienceGMessage,
-	"send_moon_message_today":    batch.SendMoonMessageToday,
-	"send_moon_message_tomorrow": batch.SendMoonMessageTomorrow,
-	"send_notice":                batch.SendNotice,
-}
-
-
 // BatchHandler executes a batch job by name.
 // POST /batch/:name
+// With ?dry_run=true the batch is run synchronously without sending anything,
+// and the messages it would send are returned. ?date=2006-01-02 previews
+// the batch as it would run on that date.
+// ?force=true re-runs a batch that already ran today.
 func BatchHandler(c *gin.Context) {
 	name := c.Param("name")
 
-	fn, ok := batchRegistry[name]
+	job, ok := batch.Lookup(name)
 	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "unknown batch: " + name})
 		return
 	}
 
+	if c.Query("dry_run") == "true" {
+		dryRunBatch(c, job)
+		return
+	}
+
+	force := c.Query("force") == "true"
+	log.Printf("Batch %s requested by %s (force: %t)", name, c.GetString("batch_caller"), force)
+
 	// 非同期で実行（Cloud Schedulerのタイムアウトを避ける）
-	go fn()
+	run, err := batch.Start(job, force)
+	if errors.Is(err, batch.ErrShuttingDown) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "shutting down"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting batch %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot start batch"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "started", "batch": name, "run_id": run.RunID})
+}
+
+func dryRunBatch(c *gin.Context, job batch.Job) {
+	date := time.Now()
+	if d := c.Query("date"); d != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", d, model.Tokyo)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+			return
+		}
+		date = parsed
+	}
+
+	log.Printf("Batch %s dry run for %s requested by %s", job.Name, date.In(model.Tokyo).Format("2006-01-02"), c.GetString("batch_caller"))
+
+	preview, err := batch.DryRun(job, date)
+	if errors.Is(err, batch.ErrDryRunUnsupported) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error in batch %s dry run: %v", job.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
 
-	c.JSON(http.StatusOK, gin.H{"status": "started", "batch": name})
+// BatchRunsHandler lists recent batch runs, newest first.
+// GET /batch/runs?name=send_daily_g_message&limit=20
+func BatchRunsHandler(c *gin.Context) {
+	name := c.Query("name")
+	// URL と同じバッチ名でも絞り込めるようにする
+	if job, ok := batch.Lookup(name); ok {
+		name = job.Name
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+		return
+	}
+
+	runs, err := model.GetBatchRuns(name, limit)
+	if err != nil {
+		log.Printf("Error listing batch runs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot list batch runs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// BatchRunHandler returns a single batch run.
+// GET /batch/runs/:id
+func BatchRunHandler(c *gin.Context) {
+	run := model.FindBatchRunByRunID(c.Param("id"))
+	if run == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "batch run not found"})
+		return
+	}
+	failures, err := model.GetSendFailures(run.RunID)
+	if err != nil {
+		log.Printf("Error getting send failures of run %s: %v", run.RunID, err)
+	}
+	run.Failures = failures
+	c.JSON(http.StatusOK, run)
+}
+
+// BatchResendHandler queues the messages of a batch run that LINE did not
+// accept to the outbox, to just the recipients that missed them. Resends
+// that fail again show up as failures of the run.
+// POST /batch/runs/:id/resend
+func BatchResendHandler(c *gin.Context) {
+	run := model.FindBatchRunByRunID(c.Param("id"))
+	if run == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "batch run not found"})
+		return
+	}
+
+	log.Printf("Resend of batch run %s requested by %s", run.RunID, c.GetString("batch_caller"))
+
+	queued, err := service.ResendFailures(run.RunID, "")
+	if errors.Is(err, model.ErrSendFailureResent) {
+		c.JSON(http.StatusConflict, gin.H{"error": "resend already in progress"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error resending batch run %s: %v", run.RunID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot resend"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"run_id": run.RunID, "queued": queued})
 }
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/RyokouKanai/gomethod/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// BatchAuthMiddleware authenticates calls to the /batch endpoints. A call is
+// accepted with either
+//
+//   - the shared secret: "Authorization: Bearer $BATCH_AUTH_TOKEN"
+//   - a Google-signed OIDC ID token (Cloud Scheduler oidc_token) whose
+//     audience is $BATCH_OIDC_AUDIENCE
+//
+// Other settings:
+//
+//	BATCH_OIDC_SERVICE_ACCOUNTS: comma-separated emails allowed to call (optional)
+//	BATCH_OIDC_JWKS_FILE:        local JWKS file instead of Google's keys (tests)
+//	BATCH_OIDC_JWKS_URL:         JWKS URL (default: Google)
+//	BATCH_OIDC_ISSUERS:          comma-separated issuers (default: Google)
+//
+// When nothing is configured every call is rejected.
+func BatchAuthMiddleware() gin.HandlerFunc {
+	sharedToken := os.Getenv("BATCH_AUTH_TOKEN")
+	verifier := newBatchVerifier()
+	if sharedToken == "" && verifier == nil {
+		log.Println("Batch auth: neither BATCH_AUTH_TOKEN nor BATCH_OIDC_AUDIENCE is set; all /batch calls will be rejected")
+	}
+
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c.GetHeader("Authorization"))
+		if !ok {
+			rejectBatchCall(c, "anonymous", errors.New("missing bearer token"))
+			return
+		}
+
+		if sharedToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sharedToken)) == 1 {
+			c.Set("batch_caller", "shared-token")
+			c.Next()
+			return
+		}
+
+		if verifier == nil {
+			rejectBatchCall(c, "unknown", errors.New("invalid token"))
+			return
+		}
+		claims, err := verifier.Verify(c.Request.Context(), token)
+		if err != nil {
+			rejectBatchCall(c, unverifiedIdentity(token), err)
+			return
+		}
+		c.Set("batch_caller", claims.Identity())
+		c.Next()
+	}
+}
+
+func newBatchVerifier() *auth.Verifier {
+	aud := os.Getenv("BATCH_OIDC_AUDIENCE")
+	if aud == "" {
+		return nil
+	}
+
+	var keys auth.KeySource
+	if path := os.Getenv("BATCH_OIDC_JWKS_FILE"); path != "" {
+		fileKeys, err := auth.NewFileKeySource(path)
+		if err != nil {
+			log.Printf("Batch auth: cannot load %s: %v", path, err)
+			return nil
+		}
+		keys = fileKeys
+	} else {
+		keys = auth.NewRemoteKeySource(getEnv("BATCH_OIDC_JWKS_URL", auth.GoogleJWKSURL))
+	}
+
+	issuers := auth.GoogleIssuers
+	if v := os.Getenv("BATCH_OIDC_ISSUERS"); v != "" {
+		issuers = splitList(v)
+	}
+
+	return &auth.Verifier{
+		Keys:          keys,
+		Audience:      aud,
+		Issuers:       issuers,
+		AllowedEmails: splitList(os.Getenv("BATCH_OIDC_SERVICE_ACCOUNTS")),
+	}
+}
+
+func rejectBatchCall(c *gin.Context, identity string, err error) {
+	log.Printf("Rejected batch call %s %s from %s (caller: %s): %v",
+		c.Request.Method, c.Request.URL.Path, c.ClientIP(), identity, err)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+}
+
+// unverifiedIdentity extracts the caller claimed by a token for logging only.
+func unverifiedIdentity(token string) string {
+	claims, err := auth.UnverifiedClaims(token)
+	if err != nil || claims.Identity() == "" {
+		return "unknown"
+	}
+	return claims.Identity() + " (unverified)"
+}
+
+func bearerToken(header string) (string, bool) {
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
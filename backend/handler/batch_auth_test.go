@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testSharedToken = "shared-secret"
+	testAudience    = "https://gomethod.example/batch"
+	testCaller      = "scheduler@gomethod.iam.gserviceaccount.com"
+)
+
+// setupBatchAuth configures BatchAuthMiddleware with the shared token and a
+// local JWKS, and returns a key that signs accepted ID tokens.
+func setupBatchAuth(t *testing.T) (*gin.Engine, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kid": "test-key",
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("BATCH_AUTH_TOKEN", testSharedToken)
+	t.Setenv("BATCH_OIDC_AUDIENCE", testAudience)
+	t.Setenv("BATCH_OIDC_JWKS_FILE", path)
+	t.Setenv("BATCH_OIDC_ISSUERS", "https://accounts.google.com")
+	t.Setenv("BATCH_OIDC_SERVICE_ACCOUNTS", testCaller)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/batch/test", BatchAuthMiddleware(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"caller": c.GetString("batch_caller")})
+	})
+	return r, key
+}
+
+func signIDToken(t *testing.T, key *rsa.PrivateKey, email string) string {
+	t.Helper()
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            testAudience,
+		"email":          email,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestBatchAuthMiddleware(t *testing.T) {
+	r, key := setupBatchAuth(t)
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantCaller    string
+	}{
+		{name: "shared token", authorization: "Bearer " + testSharedToken, wantStatus: http.StatusOK, wantCaller: "shared-token"},
+		{name: "shared token lowercase scheme", authorization: "bearer " + testSharedToken, wantStatus: http.StatusOK, wantCaller: "shared-token"},
+		{name: "ID token", authorization: "Bearer " + signIDToken(t, key, testCaller), wantStatus: http.StatusOK, wantCaller: testCaller},
+		{name: "ID token of another caller", authorization: "Bearer " + signIDToken(t, key, "someone@example.com"), wantStatus: http.StatusUnauthorized},
+		{name: "wrong shared token", authorization: "Bearer wrong-secret", wantStatus: http.StatusUnauthorized},
+		{name: "missing header", wantStatus: http.StatusUnauthorized},
+		{name: "basic scheme", authorization: "Basic " + testSharedToken, wantStatus: http.StatusUnauthorized},
+		{name: "empty bearer", authorization: "Bearer ", wantStatus: http.StatusUnauthorized},
+		{name: "blank bearer", authorization: "Bearer    ", wantStatus: http.StatusUnauthorized},
+		{name: "malformed token", authorization: "Bearer a.b.c", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/batch/test", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantCaller == "" {
+				return
+			}
+			var body struct{ Caller string }
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Caller != tt.wantCaller {
+				t.Errorf("batch_caller = %q, want %q", body.Caller, tt.wantCaller)
+			}
+		})
+	}
+}
+
+func TestBatchAuthMiddlewareWithoutConfig(t *testing.T) {
+	t.Setenv("BATCH_AUTH_TOKEN", "")
+	t.Setenv("BATCH_OIDC_AUDIENCE", "")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/batch/test", BatchAuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodGet, "/batch/test", nil)
+	req.Header.Set("Authorization", "Bearer anything")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/RyokouKanai/gomethod/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// BlobHandler serves a stored blob to a URL made by storage.URL. The bucket
+// itself is private; only holders of an unexpired signed URL can read.
+// GET /blobs/*key?expires=...&sig=...
+func BlobHandler(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" || !storage.VerifySignature(key, c.Query("expires"), c.Query("sig")) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	body, contentType, err := storage.Default().Open(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening blob %s: %v", key, err)
+		c.Status(http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, body); err != nil {
+		log.Printf("Error sending blob %s: %v", key, err)
+	}
+}
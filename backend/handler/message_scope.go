@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/gin-gonic/gin"
+)
+
+// MessageScopesHandler lists the message scopes and whether the ones the
+// code needs all resolve.
+// GET /batch/message_scopes
+func MessageScopesHandler(c *gin.Context) {
+	scopes, err := model.GetMessageScopes()
+	if err != nil {
+		log.Printf("Error listing message scopes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot list message scopes"})
+		return
+	}
+	problems := ""
+	if err := model.CheckMessageScopes(); err != nil {
+		problems = err.Error()
+	}
+	c.JSON(http.StatusOK, gin.H{"scopes": scopes, "required": model.RequiredMessageScopeNames(), "problems": problems})
+}
+
+// UpdateMessageScopeHandler points a scope at another message.
+// PUT /batch/message_scopes/:name {"message_id": 110}
+func UpdateMessageScopeHandler(c *gin.Context) {
+	var req struct {
+		MessageID uint `json:"message_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message_id is required"})
+		return
+	}
+	scope, err := model.SetMessageScope(c.Param("name"), req.MessageID)
+	if err != nil {
+		log.Printf("Error updating message scope %s: %v", c.Param("name"), err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Message scope %s now points to message %d", scope.Name, scope.MessageID)
+	c.JSON(http.StatusOK, scope)
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/gin-gonic/gin"
+)
+
+// OutboxHandler lists outgoing LINE messages with their delivery status,
+// newest first. source is a batch run ID or an admin broadcast group.
+// GET /batch/outbox?source=...&status=failed&limit=50
+func OutboxHandler(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", model.OutboxPending, model.OutboxSending, model.OutboxSent, model.OutboxFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown status"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+		return
+	}
+
+	msgs, err := model.GetOutboxMessages(c.Query("source"), status, limit)
+	if err != nil {
+		log.Printf("Error listing outbox messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot list outbox messages"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": msgs})
+}
+
+// OutboxMessageHandler returns a single outbox message.
+// GET /batch/outbox/:id
+func OutboxMessageHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	m := model.FindOutboxMessageByID(uint(id))
+	if m == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "outbox message not found"})
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/gin-gonic/gin"
+)
+
+// ReplyFallbacksHandler shows how often reply tokens were rejected and what
+// happened to those replies: counts by outcome over the last days, and the
+// latest fallbacks.
+// GET /batch/reply_fallbacks?days=30&outcome=pushed&limit=50
+func ReplyFallbacksHandler(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 || days > 365 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 365"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+		return
+	}
+
+	counts, err := model.CountReplyFallbacks(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Printf("Error counting reply fallbacks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot count reply fallbacks"})
+		return
+	}
+	latest, err := model.GetReplyFallbacks(c.Query("outcome"), limit)
+	if err != nil {
+		log.Printf("Error listing reply fallbacks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot list reply fallbacks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"days": days, "counts": counts, "fallbacks": latest})
+}
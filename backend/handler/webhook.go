@@ -28,28 +28,37 @@ func WebhookHandler(c *gin.Context) {
 		return
 	}
 
-	var webhook LineWebhookBody
+	var webhook struct {
+		Events []json.RawMessage `json:"events"`
+	}
 	if err := json.Unmarshal(body, &webhook); err != nil {
 		log.Printf("Error parsing events: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot parse events"})
 		return
 	}
 
-	es := service.NewEventService()
-	for _, event := range webhook.Events {
-		switch event.Type {
-		case "follow":
-			es.HandleFollow(event.Source.UserID)
-		case "message":
-			text := ""
-			if event.Message.Text != "" {
-				text = event.Message.Text
-			} else if event.Message.ID != "" {
-				text = event.Message.ID
-			}
-			es.HandleMessage(event.Source.UserID, text, event.ReplyToken)
+	// イベントは保存してキューに積むだけにして、すぐに 200 を返す
+	// キューに積めなかった場合は 503 を返して LINE に再送させる。
+	// 順番が入れ替わらないよう、同じユーザーの後続イベントも積まない。
+	// 積んだイベントは再送時に重複として飛ばされる。
+	refused := map[string]bool{}
+	for _, raw := range webhook.Events {
+		var event LineEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			log.Printf("Error parsing event: %v", err)
+			continue
+		}
+		if refused[event.Source.UserID] {
+			continue
+		}
+		if err := enqueueEvent(event, raw); err != nil {
+			refused[event.Source.UserID] = true
 		}
 	}
+	if len(refused) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "queue is full"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
@@ -67,10 +76,17 @@ func validateSignature(body []byte, signature string) bool {
 
 // LineEvent represents a simplified LINE webhook event.
 type LineEvent struct {
-	Type       string      `json:"type"`
-	ReplyToken string      `json:"replyToken"`
-	Source     LineSource  `json:"source"`
-	Message    LineMessage `json:"message"`
+	Type            string              `json:"type"`
+	WebhookEventID  string              `json:"webhookEventId"`
+	DeliveryContext LineDeliveryContext `json:"deliveryContext"`
+	ReplyToken      string              `json:"replyToken"`
+	Source          LineSource          `json:"source"`
+	Message         LineMessage         `json:"message"`
+	Postback        LinePostback        `json:"postback"`
+}
+
+type LineDeliveryContext struct {
+	IsRedelivery bool `json:"isRedelivery"`
 }
 
 type LineSource struct {
@@ -78,13 +94,45 @@ type LineSource struct {
 	UserID string `json:"userId"`
 }
 
+// LineMessage represents a LINE message object. Which fields are set depends on Type.
 type LineMessage struct {
 	ID   string `json:"id"`
 	Type string `json:"type"`
+
+	// text
 	Text string `json:"text"`
+
+	// sticker
+	PackageID string   `json:"packageId"`
+	StickerID string   `json:"stickerId"`
+	Keywords  []string `json:"keywords"`
+
+	// location
+	Title     string  `json:"title"`
+	Address   string  `json:"address"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+
+	// audio / video
+	Duration int64 `json:"duration"`
+
+	// file
+	FileName string `json:"fileName"`
+	FileSize int64  `json:"fileSize"`
 }
 
-type LineWebhookBody struct {
-	Events []LineEvent `json:"events"`
+// Input converts a non-text message into the service-level input.
+func (m LineMessage) Input() service.Input {
+	return service.Input{
+		Type:      m.Type,
+		MessageID: m.ID,
+		Address:   m.Address,
+		Latitude:  m.Latitude,
+		Longitude: m.Longitude,
+		Keywords:  m.Keywords,
+	}
 }
 
+type LinePostback struct {
+	Data string `json:"data"`
+}
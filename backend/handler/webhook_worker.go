@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/queue"
+	"github.com/RyokouKanai/gomethod/service"
+)
+
+const (
+	// recoverInterval is how often persisted but unfinished events are re-enqueued.
+	recoverInterval = 30 * time.Second
+	// staleQueuedAfter is how long a queued event of another instance may go
+	// untouched before it is assumed lost (e.g. the instance was killed) and
+	// enqueued again.
+	staleQueuedAfter = 10 * time.Minute
+	recoverBatchSize = 100
+)
+
+var (
+	webhookQueue  *queue.Pool
+	webhookEvents *service.EventService
+	stopRecover   context.CancelFunc
+
+	// このインスタンスの ID。キューに積んだイベントの owner として記録する
+	instanceID = randomHex(8)
+
+	// 処理中のイベント（ID → webhookEventId）。シャットダウン時に中断を記録する
+	inFlight sync.Map
+)
+
+// StartWebhookWorkers starts the worker pool that processes webhook events.
+// Events from the same LINE user are processed in order on one worker.
+//
+//	WEBHOOK_WORKERS:        number of workers (default 4)
+//	WEBHOOK_QUEUE_CAPACITY: total queued events before new ones are refused (default 1000)
+func StartWebhookWorkers() {
+	webhookEvents = service.NewEventService()
+	webhookQueue = queue.NewPool("webhook", getEnvInt("WEBHOOK_WORKERS", 4), getEnvInt("WEBHOOK_QUEUE_CAPACITY", 1000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopRecover = cancel
+	go recoverEvents(ctx)
+}
+
+// ShutdownWebhookWorkers stops accepting events and drains the queue.
+// Events still waiting in the queue when ctx is done stay in the DB and are
+// picked up again by the next instance. Events that were being processed are
+// marked interrupted instead, since they may have partly run.
+func ShutdownWebhookWorkers(ctx context.Context) error {
+	if stopRecover != nil {
+		stopRecover()
+	}
+	if webhookQueue == nil {
+		return nil
+	}
+	err := webhookQueue.Shutdown(ctx)
+	if err != nil {
+		inFlight.Range(func(key, value interface{}) bool {
+			id := key.(uint)
+			if _, ok := inFlight.LoadAndDelete(id); !ok {
+				return true // ちょうど処理が終わった
+			}
+			log.Printf("Webhook event %s interrupted by shutdown", value)
+			if err := model.UpdateWebhookEventStatus(id, model.WebhookEventInterrupted); err != nil {
+				log.Printf("Error updating webhook event %d: %v", id, err)
+			}
+			return true
+		})
+	}
+	return err
+}
+
+// enqueueEvent persists the event and hands it to a worker. Events already
+// seen (e.g. LINE redelivering after a timeout) are acknowledged but skipped.
+// If the user's worker is full the event is not kept, and the error tells the
+// caller to have LINE redeliver it: queueing it later could run it after the
+// user's newer events.
+func enqueueEvent(event LineEvent, payload []byte) error {
+	record := &model.WebhookEvent{
+		EventID:      event.WebhookEventID,
+		IsRedelivery: event.DeliveryContext.IsRedelivery,
+		LineUserID:   event.Source.UserID,
+		Owner:        instanceID,
+		Payload:      string(payload),
+		Status:       model.WebhookEventQueued,
+	}
+	if record.EventID == "" {
+		record.EventID = "local-" + randomHex(16)
+	}
+	if err := record.EncryptPayload(); err != nil {
+		log.Printf("Error encrypting webhook event %s: %v", record.EventID, err)
+		return submitEvent(0, event)
+	}
+
+	first, err := model.ClaimWebhookEvent(record)
+	if err != nil {
+		// 記録に失敗した場合は取りこぼしを避けるため処理を続ける
+		log.Printf("Error persisting webhook event %s: %v", record.EventID, err)
+		return submitEvent(0, event)
+	}
+	if !first {
+		log.Printf("Skipping duplicate webhook event %s (redelivery: %t)", record.EventID, record.IsRedelivery)
+		return nil
+	}
+	if err := submitEvent(record.ID, event); err != nil {
+		// 再送されたイベントを重複扱いしないよう記録を消す
+		if err := model.DeleteWebhookEvent(record.ID); err != nil {
+			log.Printf("Error deleting webhook event %d: %v", record.ID, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func submitEvent(id uint, event LineEvent) error {
+	err := webhookQueue.Submit(event.Source.UserID, func() { processEvent(id, event) })
+	if err != nil {
+		log.Printf("Error enqueueing webhook event %d: %v", id, err)
+	}
+	return err
+}
+
+func processEvent(id uint, event LineEvent) {
+	if id != 0 {
+		inFlight.Store(id, event.WebhookEventID)
+	}
+	status := model.WebhookEventFailed
+	defer func() {
+		if id != 0 {
+			if _, ok := inFlight.LoadAndDelete(id); !ok {
+				// シャットダウン時に interrupted として記録済み
+				return
+			}
+			if err := model.UpdateWebhookEventStatus(id, status); err != nil {
+				log.Printf("Error updating webhook event %d: %v", id, err)
+			}
+		}
+	}()
+
+	dispatchEvent(webhookEvents, event)
+	status = model.WebhookEventDone
+}
+
+// dispatchEvent runs the event through the service chain.
+func dispatchEvent(es *service.EventService, event LineEvent) {
+	switch event.Type {
+	case "follow":
+		es.HandleFollow(event.Source.UserID)
+	case "unfollow":
+		es.HandleUnfollow(event.Source.UserID)
+	case "message":
+		if event.Message.Type == model.InputTypeText {
+			es.HandleMessage(event.Source.UserID, event.Message.Text, event.ReplyToken)
+			return
+		}
+		es.HandleInput(event.Source.UserID, event.Message.Input(), event.ReplyToken)
+	case "postback":
+		es.HandlePostback(event.Source.UserID, event.Postback.Data, event.ReplyToken)
+	}
+}
+
+// recoverEvents periodically re-enqueues events that were persisted but never
+// processed: pending ones, and ones left queued by an instance that stopped
+// before finishing them. Events queued on this instance are still in its
+// queue, however long they wait there, so they are never enqueued again.
+func recoverEvents(ctx context.Context) {
+	ticker := time.NewTicker(recoverInterval)
+	defer ticker.Stop()
+
+	for {
+		requeueStale(model.WebhookEventPending, time.Now())
+		requeueStale(model.WebhookEventQueued, time.Now().Add(-staleQueuedAfter))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func requeueStale(status string, before time.Time) {
+	exceptOwner := ""
+	if status == model.WebhookEventQueued {
+		exceptOwner = instanceID
+	}
+	events, err := model.FindStaleWebhookEvents(status, before, exceptOwner, recoverBatchSize)
+	if err != nil {
+		log.Printf("Error finding %s webhook events: %v", status, err)
+		return
+	}
+	for i := range events {
+		ok, err := model.RequeueWebhookEvent(&events[i], instanceID)
+		if err != nil || !ok {
+			continue
+		}
+		var event LineEvent
+		payload, err := events[i].PlainPayload()
+		if err == nil {
+			err = json.Unmarshal([]byte(payload), &event)
+		}
+		if err != nil {
+			log.Printf("Error decoding webhook event %d: %v", events[i].ID, err)
+			model.UpdateWebhookEventStatus(events[i].ID, model.WebhookEventFailed)
+			continue
+		}
+		log.Printf("Re-enqueueing %s webhook event %s", status, events[i].EventID)
+		if err := submitEvent(events[i].ID, event); err != nil {
+			// 次の回で拾い直す
+			model.UpdateWebhookEventStatus(events[i].ID, model.WebhookEventPending)
+		}
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getEnvInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,267 @@
+// Package linestub is a local stand-in for the LINE Messaging API, so the
+// bot can be run and tested end to end without LINE credentials. Point the
+// app at it with LINE_API_ENDPOINT and LINE_API_DATA_ENDPOINT.
+//
+// It accepts reply, push, multicast and broadcast requests, records them and
+// answers like LINE: a request ID on every response, 409 with the accepted
+// request ID when a retry key is repeated, and 400 "Invalid reply token"
+// when a reply token is used twice. Loading animation, quota and rich menu
+// requests are recorded and acknowledged, so menus can be synced and linked
+// against it. Tests can inspect and steer it in-process or over HTTP:
+//
+//	GET  /_stub/requests            recorded requests
+//	POST /_stub/reset               forget recorded requests
+//	POST /_stub/fail?status=500&n=1 fail the next n sends with status
+package linestub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request is a request the stub received.
+type Request struct {
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	RetryKey  string          `json:"retry_key,omitempty"`
+	RequestID string          `json:"request_id"`
+	Status    int             `json:"status"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	At        time.Time       `json:"at"`
+}
+
+// sendPaths are the endpoints that send messages.
+var sendPaths = map[string]bool{
+	"/v2/bot/message/reply":     true,
+	"/v2/bot/message/push":      true,
+	"/v2/bot/message/multicast": true,
+	"/v2/bot/message/broadcast": true,
+}
+
+// Server is the stub. It is an http.Handler; serve it with httptest.NewServer
+// in tests or with cmd/linestub locally.
+type Server struct {
+	// Content is returned for message content downloads.
+	Content     []byte
+	ContentType string
+
+	mu       sync.Mutex
+	requests []Request
+	accepted map[string]string // retry key → request ID
+	replied  map[string]bool   // used reply tokens
+	failures []int
+	seq      int
+}
+
+// NewServer creates a stub that serves a 1x1 PNG as message content.
+func NewServer() *Server {
+	return &Server{
+		Content:     onePixelPNG,
+		ContentType: "image/png",
+		accepted:    map[string]string{},
+		replied:     map[string]bool{},
+	}
+}
+
+// Requests returns the recorded requests, oldest first.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Sends returns the recorded requests to the given path, e.g. "/v2/bot/message/push".
+func (s *Server) Sends(path string) []Request {
+	var reqs []Request
+	for _, r := range s.Requests() {
+		if r.Path == path {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// Reset forgets the recorded requests, accepted retry keys and pending failures.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.accepted = map[string]string{}
+	s.replied = map[string]bool{}
+	s.failures = nil
+}
+
+// FailNext makes the next sends fail with the given statuses, one each.
+func (s *Server) FailNext(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_stub/"):
+		s.serveControl(w, r)
+		return
+	case !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "):
+		writeJSON(w, http.StatusUnauthorized, "", map[string]string{"message": "Authentication failed"})
+		return
+	case r.Method == http.MethodPost && sendPaths[r.URL.Path]:
+		s.serveSend(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2/bot/message/") && strings.HasSuffix(r.URL.Path, "/content"):
+		id := s.record(r, http.StatusOK, nil)
+		w.Header().Set("X-Line-Request-Id", id)
+		w.Header().Set("Content-Type", s.ContentType)
+		w.Write(s.Content)
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/bot/chat/loading/start":
+		body, _ := io.ReadAll(r.Body)
+		writeJSON(w, http.StatusAccepted, s.record(r, http.StatusAccepted, body), map[string]string{})
+	case r.Method == http.MethodGet && r.URL.Path == "/v2/bot/message/quota":
+		writeJSON(w, http.StatusOK, s.record(r, http.StatusOK, nil), map[string]string{"type": "none"})
+	case r.Method == http.MethodGet && r.URL.Path == "/v2/bot/message/quota/consumption":
+		writeJSON(w, http.StatusOK, s.record(r, http.StatusOK, nil), map[string]int{"totalUsage": len(s.Sends("/v2/bot/message/push"))})
+	case strings.HasPrefix(r.URL.Path, "/v2/bot/richmenu") || strings.HasPrefix(r.URL.Path, "/v2/bot/user/"):
+		s.serveRichMenu(w, r)
+	default:
+		s.record(r, http.StatusNotFound, nil)
+		writeJSON(w, http.StatusNotFound, "", map[string]string{"message": "Not found"})
+	}
+}
+
+func (s *Server) serveSend(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !json.Valid(body) {
+		s.record(r, http.StatusBadRequest, body)
+		writeJSON(w, http.StatusBadRequest, "", map[string]string{"message": "The request body has 1 error(s)"})
+		return
+	}
+
+	key := r.Header.Get("X-Line-Retry-Key")
+	s.mu.Lock()
+	acceptedID, repeated := s.accepted[key]
+	var status int
+	if len(s.failures) > 0 && !repeated {
+		status, s.failures = s.failures[0], s.failures[1:]
+	}
+	usedToken := false
+	if r.URL.Path == "/v2/bot/message/reply" && status == 0 {
+		var req struct {
+			ReplyToken string `json:"replyToken"`
+		}
+		json.Unmarshal(body, &req)
+		usedToken = s.replied[req.ReplyToken]
+		s.replied[req.ReplyToken] = true
+	}
+	s.mu.Unlock()
+
+	switch {
+	case usedToken:
+		id := s.record(r, http.StatusBadRequest, body)
+		writeJSON(w, http.StatusBadRequest, id, map[string]string{"message": "Invalid reply token"})
+	case repeated && key != "":
+		s.record(r, http.StatusConflict, body)
+		w.Header().Set("X-Line-Accepted-Request-Id", acceptedID)
+		writeJSON(w, http.StatusConflict, s.nextID(), map[string]string{"message": "The retry key is already accepted"})
+	case status != 0:
+		id := s.record(r, status, body)
+		writeJSON(w, status, id, map[string]string{"message": http.StatusText(status)})
+	default:
+		id := s.record(r, http.StatusOK, body)
+		if key != "" {
+			s.mu.Lock()
+			s.accepted[key] = id
+			s.mu.Unlock()
+		}
+		writeJSON(w, http.StatusOK, id, map[string]interface{}{"sentMessages": []interface{}{}})
+	}
+}
+
+// serveRichMenu acknowledges rich menu requests. Creating a menu returns a
+// new rich menu ID; image uploads are recorded without their body.
+func (s *Server) serveRichMenu(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !json.Valid(body) {
+		body = nil
+	}
+	id := s.record(r, http.StatusOK, body)
+	if r.Method == http.MethodPost && r.URL.Path == "/v2/bot/richmenu" {
+		writeJSON(w, http.StatusOK, id, map[string]string{"richMenuId": "richmenu-" + id})
+		return
+	}
+	writeJSON(w, http.StatusOK, id, map[string]string{})
+}
+
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/_stub/requests":
+		writeJSON(w, http.StatusOK, "", map[string]interface{}{"requests": s.Requests()})
+	case "/_stub/reset":
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	case "/_stub/fail":
+		status, err := strconv.Atoi(r.URL.Query().Get("status"))
+		if err != nil || status < 400 {
+			http.Error(w, "status must be an error status", http.StatusBadRequest)
+			return
+		}
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			s.FailNext(status)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// record stores the request and returns its request ID.
+func (s *Server) record(r *http.Request, status int, body []byte) string {
+	id := s.nextID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		RetryKey:  r.Header.Get("X-Line-Retry-Key"),
+		RequestID: id,
+		Status:    status,
+		Body:      body,
+		At:        time.Now(),
+	})
+	return id
+}
+
+func (s *Server) nextID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return fmt.Sprintf("stub-%08d", s.seq)
+}
+
+func writeJSON(w http.ResponseWriter, status int, requestID string, v interface{}) {
+	if requestID != "" {
+		w.Header().Set("X-Line-Request-Id", requestID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// onePixelPNG is a transparent 1x1 PNG.
+var onePixelPNG = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+	0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4, 0x89, 0x00, 0x00, 0x00,
+	0x0d, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x63, 0x00, 0x01, 0x00, 0x00,
+	0x05, 0x00, 0x01, 0x0d, 0x0a, 0x2d, 0xb4, 0x00, 0x00, 0x00, 0x00, 0x49,
+	0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
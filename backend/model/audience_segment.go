@@ -0,0 +1,243 @@
+package model
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"gorm.io/gorm"
+)
+
+// AudienceSegment is a saved set of users an admin can broadcast to.
+// Empty filters match everyone; set filters are combined with AND.
+type AudienceSegment struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	Position int    `gorm:"column:position;not null;uniqueIndex" json:"position"` // 管理者がチャットで選ぶ番号
+	Name     string `gorm:"column:name;size:64;not null" json:"name"`
+	// All sends with LINE's broadcast API to every friend instead of
+	// filtering users; the other filters are ignored.
+	All bool `gorm:"column:all_users;not null;default:false" json:"all"`
+
+	MemberTypes      string     `gorm:"column:member_types;size:255" json:"member_types"` // カンマ区切り
+	PlanIDs          string     `gorm:"column:plan_ids;size:255" json:"plan_ids"`         // カンマ区切り
+	IsShik           *bool      `gorm:"column:is_shik" json:"is_shik"`
+	IsActive         *bool      `gorm:"column:is_active" json:"is_active"`
+	IncludeBlocked   bool       `gorm:"column:include_blocked;not null;default:false" json:"include_blocked"`
+	SignedUpFrom     *time.Time `gorm:"column:signed_up_from;type:date" json:"signed_up_from"`
+	SignedUpTo       *time.Time `gorm:"column:signed_up_to;type:date" json:"signed_up_to"`
+	ActiveWithinDays *int       `gorm:"column:active_within_days" json:"active_within_days"`
+	InactiveForDays  *int       `gorm:"column:inactive_for_days" json:"inactive_for_days"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (AudienceSegment) TableName() string { return "audience_segments" }
+
+// GetAudienceSegments returns all segments in position order.
+func GetAudienceSegments() ([]AudienceSegment, error) {
+	var segments []AudienceSegment
+	err := database.DB.Order("position ASC").Find(&segments).Error
+	return segments, err
+}
+
+// FindAudienceSegmentByPosition finds the segment an admin selected by number.
+func FindAudienceSegmentByPosition(position int) *AudienceSegment {
+	var s AudienceSegment
+	if err := database.DB.Where("position = ?", position).First(&s).Error; err != nil {
+		return nil
+	}
+	return &s
+}
+
+// FindAudienceSegmentByID finds a segment by ID.
+func FindAudienceSegmentByID(id uint) *AudienceSegment {
+	var s AudienceSegment
+	if err := database.DB.First(&s, id).Error; err != nil {
+		return nil
+	}
+	return &s
+}
+
+// ErrSegmentInUse is returned when deleting a segment that pending scheduled
+// broadcasts are addressed to.
+var ErrSegmentInUse = errors.New("segment has pending scheduled broadcasts")
+
+// CreateAudienceSegment saves a new segment after the existing ones and adds
+// it as an option of the select_broadcast_range message, continuing like the
+// message's other options, so admins can pick it in the chat.
+func CreateAudienceSegment(s *AudienceSegment) error {
+	if s.Name == "" {
+		return errors.New("segment name is required")
+	}
+	picker := GetMessageByScope("select_broadcast_range")
+	if picker == nil {
+		return errors.New("select_broadcast_range message not found")
+	}
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var existing ReplyPattern
+		err := tx.Where("sent_message_id = ? AND position IS NOT NULL", picker.ID).
+			Order("id ASC").Limit(1).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		if existing.ID == 0 {
+			return errors.New("select_broadcast_range has no option to continue like")
+		}
+
+		// 選択肢の番号と配信対象の番号は揃えておく
+		position, err := nextOptionPosition(tx, picker.ID)
+		if err != nil {
+			return err
+		}
+		var lastSegment int
+		if err := tx.Model(&AudienceSegment{}).Select("COALESCE(MAX(position), 0)").Scan(&lastSegment).Error; err != nil {
+			return err
+		}
+		if lastSegment >= position {
+			position = lastSegment + 1
+		}
+
+		s.ID = 0
+		s.Position = position
+		if err := tx.Create(s).Error; err != nil {
+			return err
+		}
+		return createOptionPattern(tx, picker.ID, position, s.Name, existing.NextMessageID, existing.ExecutionMethod)
+	})
+}
+
+// DeleteAudienceSegment deletes the segment and its option on the
+// select_broadcast_range message. Segments that pending scheduled broadcasts
+// are addressed to are kept.
+func DeleteAudienceSegment(id uint) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var s AudienceSegment
+		if err := tx.First(&s, id).Error; err != nil {
+			return err
+		}
+		var pending int64
+		err := tx.Model(&ScheduledBroadcast{}).
+			Where("segment_id = ? AND status IN ?", s.ID, unsentScheduledBroadcast).
+			Count(&pending).Error
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrSegmentInUse
+		}
+
+		if picker := GetMessageByScope("select_broadcast_range"); picker != nil {
+			if err := tx.Where("message_id = ? AND position = ?", picker.ID, s.Position).Delete(&Option{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("sent_message_id = ? AND position = ?", picker.ID, s.Position).Delete(&ReplyPattern{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&s).Error
+	})
+}
+
+// users returns a query for the users in the segment.
+func (s *AudienceSegment) users() *gorm.DB {
+	q := database.DB.Model(&User{})
+	if !s.IncludeBlocked {
+		q = q.Where("follow_state = ?", FollowStateFollowing)
+	}
+	if types := splitList(s.MemberTypes); len(types) > 0 {
+		q = q.Where("member_type IN ?", types)
+	}
+	if ids := splitList(s.PlanIDs); len(ids) > 0 {
+		planIDs := make([]int64, 0, len(ids))
+		for _, id := range ids {
+			if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+				planIDs = append(planIDs, n)
+			}
+		}
+		q = q.Where("plan_id IN ?", planIDs)
+	}
+	if s.IsShik != nil {
+		q = q.Where("is_shik = ?", *s.IsShik)
+	}
+	if s.IsActive != nil {
+		q = q.Where("is_active = ?", *s.IsActive)
+	}
+	if s.SignedUpFrom != nil {
+		q = q.Where("created_at >= ?", *s.SignedUpFrom)
+	}
+	if s.SignedUpTo != nil {
+		q = q.Where("created_at < ?", s.SignedUpTo.AddDate(0, 0, 1))
+	}
+	// 最終利用日はトーク履歴から判定する
+	if s.ActiveWithinDays != nil {
+		since := time.Now().AddDate(0, 0, -*s.ActiveWithinDays)
+		q = q.Where("id IN (?)", database.DB.Model(&TalkHistory{}).Select("user_id").Where("created_at >= ?", since))
+	}
+	if s.InactiveForDays != nil {
+		since := time.Now().AddDate(0, 0, -*s.InactiveForDays)
+		q = q.Where("id NOT IN (?)", database.DB.Model(&TalkHistory{}).Select("user_id").Where("created_at >= ?", since))
+	}
+	return q
+}
+
+// CountRecipients returns how many users the segment reaches.
+func (s *AudienceSegment) CountRecipients() (int64, error) {
+	if s.All {
+		return CountFollowingUsers()
+	}
+	var count int64
+	err := s.users().Count(&count).Error
+	return count, err
+}
+
+// LineUserIDs returns the LINE user IDs of the users in the segment.
+func (s *AudienceSegment) LineUserIDs() ([]string, error) {
+	var ids []string
+	err := s.users().Pluck("line_user_id", &ids).Error
+	return ids, err
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// seedAudienceSegments creates the segments matching the options of the
+// select_broadcast_range message when there are none yet, so the existing
+// chat flow keeps working: "シックのみ" goes to shik users and anything
+// else to everyone, as the broadcasts action used to decide.
+func seedAudienceSegments() error {
+	var count int64
+	if err := database.DB.Model(&AudienceSegment{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+
+	shik := true
+	segments := []AudienceSegment{
+		{Position: 1, Name: "全員", All: true},
+		{Position: 2, Name: "シックのみ", IsShik: &shik},
+	}
+	if msg := GetMessageByScope("select_broadcast_range"); msg != nil {
+		if options, err := msg.GetOptions(); err == nil && len(options) > 0 {
+			segments = segments[:0]
+			for _, o := range options {
+				s := AudienceSegment{Position: o.Position, Name: o.GetContent()}
+				if s.Name == "シックのみ" {
+					s.IsShik = &shik
+				} else {
+					s.All = true
+				}
+				segments = append(segments, s)
+			}
+		}
+	}
+	return database.DB.Create(&segments).Error
+}
@@ -0,0 +1,109 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"gorm.io/gorm"
+)
+
+// Batch run outcomes.
+const (
+	BatchRunRunning   = "running"
+	BatchRunSucceeded = "succeeded"
+	BatchRunFailed    = "failed"
+	BatchRunSkipped   = "skipped"
+	// BatchRunInterrupted means the instance shut down before the run finished.
+	BatchRunInterrupted = "interrupted"
+)
+
+// BatchRun is the ledger entry for a single execution of a batch.
+// RecipientCount and MessageCount are what the run queued in the outbox;
+// SentCount and FailedCount are the recipients the outbox then delivered to
+// or gave up on, added as it sends.
+type BatchRun struct {
+	ID             uint       `gorm:"primaryKey" json:"-"`
+	RunID          string     `gorm:"column:run_id;size:32;not null;uniqueIndex" json:"run_id"`
+	Name           string     `gorm:"column:name;size:64;not null;index" json:"name"`
+	Status         string     `gorm:"column:status;size:16;not null" json:"status"`
+	StartedAt      time.Time  `gorm:"column:started_at" json:"started_at"`
+	FinishedAt     *time.Time `gorm:"column:finished_at" json:"finished_at"`
+	Error          *string    `gorm:"column:error;type:text" json:"error"`
+	RecipientCount int        `gorm:"column:recipient_count;not null;default:0" json:"recipient_count"`
+	MessageCount   int        `gorm:"column:message_count;not null;default:0" json:"message_count"`
+	SentCount      int        `gorm:"column:sent_count;not null;default:0" json:"sent_count"`
+	FailedCount    int        `gorm:"column:failed_count;not null;default:0" json:"failed_count"`
+	CreatedAt      time.Time  `json:"-"`
+	UpdatedAt      time.Time  `json:"-"`
+
+	// Failures are the sends LINE did not accept, filled in by the status API.
+	Failures []SendFailure `gorm:"-" json:"failures,omitempty"`
+}
+
+func (BatchRun) TableName() string { return "batch_runs" }
+
+// CreateBatchRun records the start of a batch run.
+func CreateBatchRun(name string) (*BatchRun, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	r := &BatchRun{
+		RunID:     hex.EncodeToString(id),
+		Name:      name,
+		Status:    BatchRunRunning,
+		StartedAt: time.Now(),
+	}
+	return r, database.DB.Create(r).Error
+}
+
+// Finish records the outcome of the run.
+func (r *BatchRun) Finish(status string, runErr error) error {
+	now := time.Now()
+	r.Status = status
+	r.FinishedAt = &now
+	if runErr != nil {
+		msg := runErr.Error()
+		r.Error = &msg
+	}
+	// sent_count と failed_count は配信側（アウトボックス）が加算するため上書きしない
+	return database.DB.Model(r).
+		Select("status", "finished_at", "error", "recipient_count", "message_count").
+		Updates(r).Error
+}
+
+// AddBatchRunSent adds to the sent count of the run with the given run ID.
+// Sources that are not batch runs match no row and are ignored.
+func AddBatchRunSent(runID string, n int) error {
+	return database.DB.Model(&BatchRun{}).Where("run_id = ?", runID).
+		Update("sent_count", gorm.Expr("sent_count + ?", n)).Error
+}
+
+// AddBatchRunFailures adds to the failed count of the run with the given run
+// ID. Sources that are not batch runs match no row and are ignored.
+func AddBatchRunFailures(runID string, n int) error {
+	return database.DB.Model(&BatchRun{}).Where("run_id = ?", runID).
+		Update("failed_count", gorm.Expr("failed_count + ?", n)).Error
+}
+
+// FindBatchRunByRunID finds a batch run by its run ID.
+func FindBatchRunByRunID(runID string) *BatchRun {
+	var r BatchRun
+	if err := database.DB.Where("run_id = ?", runID).First(&r).Error; err != nil {
+		return nil
+	}
+	return &r
+}
+
+// GetBatchRuns returns the most recent runs, optionally filtered by batch name.
+func GetBatchRuns(name string, limit int) ([]BatchRun, error) {
+	var runs []BatchRun
+	query := database.DB.Order("id DESC").Limit(limit)
+	if name != "" {
+		query = query.Where("name = ?", name)
+	}
+	err := query.Find(&runs).Error
+	return runs, err
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"gorm.io/gorm/clause"
+)
+
+// BatchSchedule is a cron schedule for a registered batch, used by the
+// in-process scheduler.
+type BatchSchedule struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"column:name;size:64;not null;uniqueIndex" json:"name"`
+	Cron      string    `gorm:"column:cron;size:64;not null" json:"cron"`
+	TimeZone  string    `gorm:"column:time_zone;size:64;not null;default:Asia/Tokyo" json:"time_zone"`
+	Enabled   bool      `gorm:"column:enabled;not null;default:true" json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (BatchSchedule) TableName() string { return "batch_schedules" }
+
+// GetEnabledBatchSchedules returns all enabled batch schedules.
+func GetEnabledBatchSchedules() ([]BatchSchedule, error) {
+	var schedules []BatchSchedule
+	err := database.DB.Where("enabled = ?", true).Order("name ASC").Find(&schedules).Error
+	return schedules, err
+}
+
+// BatchScheduleLock records that a scheduled firing of a batch was taken by
+// an instance.
+type BatchScheduleLock struct {
+	ID          uint      `gorm:"primaryKey"`
+	Name        string    `gorm:"column:name;size:64;not null;uniqueIndex:idx_batch_schedule_lock"`
+	ScheduledAt time.Time `gorm:"column:scheduled_at;not null;uniqueIndex:idx_batch_schedule_lock"`
+	CreatedAt   time.Time
+}
+
+func (BatchScheduleLock) TableName() string { return "batch_schedule_locks" }
+
+// ClaimScheduledBatch reports whether this instance gets to fire the batch
+// scheduled at the given time. Only the first instance to claim it succeeds.
+func ClaimScheduledBatch(name string, scheduledAt time.Time) (bool, error) {
+	lock := &BatchScheduleLock{Name: name, ScheduledAt: scheduledAt.UTC()}
+	result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(lock)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
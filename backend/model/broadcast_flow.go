@@ -0,0 +1,179 @@
+package model
+
+import (
+	"log"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"gorm.io/gorm"
+)
+
+// seedBroadcastFlow adds the steps that lead to the segment list, test send
+// and scheduled broadcast actions to the admin chat flow, unless those
+// actions already have a pattern:
+//
+//   - the segment picker (scope select_broadcast_range) is shown by
+//     broadcasts_segments, which lists each segment with its recipient count
+//   - the broadcast confirmation gets a "テスト送信" option running
+//     broadcasts_test_send, which shows the confirmation again
+//   - the broadcast confirmation (the message broadcasts_confirm shows) gets
+//     a "送信予約" option asking for the send time, which is then passed to
+//     broadcasts_schedule
+//   - the admin menu (scope admin_default) gets a "送信予約の一覧" option
+//     running broadcasts_scheduled_index, after which the number entered is
+//     passed to broadcasts_scheduled_cancel
+//
+// The seeded messages can be reworded like any other afterwards.
+func seedBroadcastFlow() error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := seedBroadcastSegmentsStep(tx); err != nil {
+			return err
+		}
+		if err := seedBroadcastTestSendStep(tx); err != nil {
+			return err
+		}
+		if err := seedBroadcastScheduleStep(tx); err != nil {
+			return err
+		}
+		return seedScheduledBroadcastListStep(tx)
+	})
+}
+
+func seedBroadcastSegmentsStep(tx *gorm.DB) error {
+	if seeded, err := hasReplyPattern(tx, "broadcasts_segments"); err != nil || seeded {
+		return err
+	}
+	picker := GetMessageByScope("select_broadcast_range")
+	if picker == nil {
+		return nil
+	}
+	// 選択肢を出すだけの遷移を、人数つきの一覧を出す遷移に切り替える
+	return tx.Model(&ReplyPattern{}).
+		Where("next_message_id = ? AND execution_method = ?", picker.ID, "base").
+		Update("execution_method", "broadcasts_segments").Error
+}
+
+func seedBroadcastTestSendStep(tx *gorm.DB) error {
+	if seeded, err := hasReplyPattern(tx, "broadcasts_test_send"); err != nil || seeded {
+		return err
+	}
+	confirmID, ok, err := broadcastConfirmMessageID(tx)
+	if err != nil || !ok {
+		return err
+	}
+	return appendOptionPattern(tx, confirmID, "テスト送信", confirmID, "broadcasts_test_send")
+}
+
+func seedBroadcastScheduleStep(tx *gorm.DB) error {
+	if seeded, err := hasReplyPattern(tx, "broadcasts_schedule"); err != nil || seeded {
+		return err
+	}
+	confirmID, ok, err := broadcastConfirmMessageID(tx)
+	if err != nil || !ok {
+		return err
+	}
+
+	ask, err := createMessage(tx, "送信日時を入力してください。\n例: 10/18 8:00、明日 8:00")
+	if err != nil {
+		return err
+	}
+	done, err := createMessage(tx, "送信を予約しました。")
+	if err != nil {
+		return err
+	}
+	if err := appendOptionPattern(tx, confirmID, "送信予約", ask.ID, "base"); err != nil {
+		return err
+	}
+	return tx.Create(&ReplyPattern{
+		SentMessageID:   ask.ID,
+		NextMessageID:   done.ID,
+		ExecutionMethod: "broadcasts_schedule",
+		InputTypes:      InputTypeText,
+	}).Error
+}
+
+func seedScheduledBroadcastListStep(tx *gorm.DB) error {
+	if seeded, err := hasReplyPattern(tx, "broadcasts_scheduled_index"); err != nil || seeded {
+		return err
+	}
+	menu := GetMessageByScope("admin_default")
+	if menu == nil {
+		log.Println("Admin menu not found; scheduled broadcasts can't be listed from the chat")
+		return nil
+	}
+
+	list, err := createMessage(tx, "キャンセルする場合は予約の番号を送ってください。")
+	if err != nil {
+		return err
+	}
+	cancelled, err := createMessage(tx, "送信予約をキャンセルしました。")
+	if err != nil {
+		return err
+	}
+	if err := appendOptionPattern(tx, menu.ID, "送信予約の一覧", list.ID, "broadcasts_scheduled_index"); err != nil {
+		return err
+	}
+	return tx.Create(&ReplyPattern{
+		SentMessageID:   list.ID,
+		NextMessageID:   cancelled.ID,
+		ExecutionMethod: "broadcasts_scheduled_cancel",
+		InputTypes:      InputTypeText,
+	}).Error
+}
+
+// broadcastConfirmMessageID returns the message shown after broadcasts_confirm.
+func broadcastConfirmMessageID(tx *gorm.DB) (uint, bool, error) {
+	var rp ReplyPattern
+	err := tx.Where("execution_method = ?", "broadcasts_confirm").Order("id ASC").Limit(1).Find(&rp).Error
+	if err != nil {
+		return 0, false, err
+	}
+	if rp.ID == 0 {
+		log.Println("No broadcasts_confirm pattern; skipping the broadcast flow seeds")
+		return 0, false, nil
+	}
+	return rp.NextMessageID, true, nil
+}
+
+func hasReplyPattern(tx *gorm.DB, method string) (bool, error) {
+	var count int64
+	err := tx.Model(&ReplyPattern{}).Where("execution_method = ?", method).Count(&count).Error
+	return count > 0, err
+}
+
+func createMessage(tx *gorm.DB, content string) (*Message, error) {
+	msg := &Message{Content: &content}
+	return msg, tx.Create(msg).Error
+}
+
+// appendOptionPattern adds an option after the message's last one, with a
+// pattern that runs the method and moves on to next when it is picked.
+func appendOptionPattern(tx *gorm.DB, messageID uint, content string, next uint, method string) error {
+	position, err := nextOptionPosition(tx, messageID)
+	if err != nil {
+		return err
+	}
+	return createOptionPattern(tx, messageID, position, content, next, method)
+}
+
+// nextOptionPosition returns the position after the message's last option.
+func nextOptionPosition(tx *gorm.DB, messageID uint) (int, error) {
+	var last int
+	err := tx.Model(&Option{}).Where("message_id = ?", messageID).
+		Select("COALESCE(MAX(position), 0)").Scan(&last).Error
+	return last + 1, err
+}
+
+// createOptionPattern adds an option at the position, with a pattern that
+// runs the method and moves on to next when it is picked.
+func createOptionPattern(tx *gorm.DB, messageID uint, position int, content string, next uint, method string) error {
+	if err := tx.Create(&Option{MessageID: messageID, Position: position, Content: &content}).Error; err != nil {
+		return err
+	}
+	return tx.Create(&ReplyPattern{
+		SentMessageID:   messageID,
+		Position:        &position,
+		NextMessageID:   next,
+		ExecutionMethod: method,
+		InputTypes:      InputTypeText,
+	}).Error
+}
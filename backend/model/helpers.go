@@ -1,7 +1,10 @@
 package model
 
 import (
+	"time"
+
 	"github.com/RyokouKanai/gomethod/database"
+	"gorm.io/gorm/clause"
 )
 
 // UpdateTalkHistoryReplyPattern updates the reply pattern ID of a talk history.
@@ -42,6 +45,16 @@ func FindWishByID(id uint) *Wish {
 	return &w
 }
 
+// FindLatestWish finds the user's most recently created wish of the given type.
+func FindLatestWish(userID uint, wishType string) *Wish {
+	var w Wish
+	err := database.DB.Where("user_id = ? AND wish_type = ?", userID, wishType).Order("id DESC").First(&w).Error
+	if err != nil {
+		return nil
+	}
+	return &w
+}
+
 // FindHateByID finds a hate by ID.
 func FindHateByID(id uint) *Hate {
 	var h Hate
@@ -60,6 +73,20 @@ func FindHappinessByID(id uint) *Happiness {
 	return &h
 }
 
+// FindLatestHappiness finds the user's most recently created happiness.
+func FindLatestHappiness(userID uint) *Happiness {
+	var h Happiness
+	if err := database.DB.Where("user_id = ?", userID).Order("id DESC").First(&h).Error; err != nil {
+		return nil
+	}
+	return &h
+}
+
+// UpdateHappinessAudioURL updates the audio URL for a happiness.
+func UpdateHappinessAudioURL(happinessID uint, url string) error {
+	return database.DB.Model(&Happiness{}).Where("id = ?", happinessID).Update("audio_url", url).Error
+}
+
 // FindFeelingSettingByID finds a feeling setting by ID.
 func FindFeelingSettingByID(id uint) *FeelingSetting {
 	var fs FeelingSetting
@@ -130,17 +157,25 @@ func FindFeelingSettingByUserAndButton(userID uint, buttonNumber int) *FeelingSe
 	return &fs
 }
 
-// CheckBatchDuplicateExecution checks if a batch was already executed today.
-func CheckBatchDuplicateExecution(batchName string) bool {
-	var beh BatchExecutionHistory
-	err := database.DB.Where("batch = ?", batchName).First(&beh).Error
-	if err != nil {
-		return false
-	}
-	if beh.IsToday() {
-		return true
+// ClaimBatchExecution records that the batch runs on the given date and
+// reports whether this is the first run that day. The insert is atomic, so of
+// two concurrent runs only one can claim the date.
+func ClaimBatchExecution(batchName string, runDate time.Time) (bool, error) {
+	date := BatchRunDate(runDate)
+	beh := &BatchExecutionHistory{Batch: batchName, RunDate: &date}
+	result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(beh)
+	if result.Error != nil {
+		return false, result.Error
 	}
-	// Touch the record
-	database.DB.Model(&beh).Update("updated_at", database.DB.NowFunc())
-	return false
+	return result.RowsAffected > 0, nil
+}
+
+// ForceBatchExecution records a run on the given date even if the date was
+// already claimed, for admins re-running a batch.
+func ForceBatchExecution(batchName string, runDate time.Time) error {
+	date := BatchRunDate(runDate)
+	beh := &BatchExecutionHistory{Batch: batchName, RunDate: &date}
+	return database.DB.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at"}),
+	}).Create(beh).Error
 }
@@ -2,6 +2,7 @@ package model
 
 import (
 	"fmt"
+	"log"
 	"strings"
 
 	"github.com/RyokouKanai/gomethod/database"
@@ -66,38 +67,17 @@ func (m *Message) GetNextReplyPattern() *ReplyPattern {
 	return &rp
 }
 
-// Message scopes - equivalent to Rails scopes
-var messageScopeIDs = map[string]uint{
-	"default":                    110,
-	"maintenance":                10,
-	"validation_error":           16,
-	"select_number":              18,
-	"bad_talk_response":          21,
-	"admin_default":              23,
-	"new_moon_tomorrow":          27,
-	"new_moon_today":             28,
-	"full_moon_tomorrow":         29,
-	"full_moon_today":            30,
-	"duplicate_send":             31,
-	"no_wishes":                  62,
-	"todays_g_message":           63,
-	"todays_weekly_g_message":    93,
-	"todays_experience_g_message": 109,
-	"select_broadcast_range":     121,
-	"over_post_capacity":         122,
-	"unavailable":                125,
-	"lets_customize_feeling_button": 127,
-	"todays_weekly_blog_g_message": 130,
-}
-
-// GetMessageByScope returns a message by its scope name.
+// GetMessageByScope returns the message the scope is assigned to (see
+// MessageScope), or nil if the scope or its message is missing.
 func GetMessageByScope(scope string) *Message {
-	id, ok := messageScopeIDs[scope]
+	id, ok := messageScopeID(scope)
 	if !ok {
+		log.Printf("Message scope %q is not assigned", scope)
 		return nil
 	}
 	var msg Message
 	if err := database.DB.First(&msg, id).Error; err != nil {
+		log.Printf("Message %d of scope %q not found: %v", id, scope, err)
 		return nil
 	}
 	return &msg
@@ -0,0 +1,179 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"gorm.io/gorm"
+)
+
+// MessageScope names the message the code uses for a purpose, such as
+// "default" for the top menu. Reassigning a scope changes which message is
+// sent without a deploy.
+type MessageScope struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"column:name;size:64;not null;uniqueIndex" json:"name"`
+	MessageID uint      `gorm:"column:message_id;not null" json:"message_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (MessageScope) TableName() string { return "message_scopes" }
+
+// requiredMessageScopes are the scopes the code looks up, with the messages
+// they pointed to when they were hard-coded (equivalent to the Rails scopes).
+// An empty table is seeded from here once; after that the table is the only
+// source, and a scope deleted from it is reported by CheckMessageScopes.
+var requiredMessageScopes = map[string]uint{
+	"default":                       110,
+	"maintenance":                   10,
+	"validation_error":              16,
+	"select_number":                 18,
+	"bad_talk_response":             21,
+	"admin_default":                 23,
+	"new_moon_tomorrow":             27,
+	"new_moon_today":                28,
+	"full_moon_tomorrow":            29,
+	"full_moon_today":               30,
+	"duplicate_send":                31,
+	"no_wishes":                     62,
+	"todays_g_message":              63,
+	"todays_weekly_g_message":       93,
+	"todays_experience_g_message":   109,
+	"select_broadcast_range":        121,
+	"over_post_capacity":            122,
+	"unavailable":                   125,
+	"lets_customize_feeling_button": 127,
+	"todays_weekly_blog_g_message":  130,
+}
+
+// messageScopeTTL is how long the scope map is used before it is read again,
+// so a scope reassigned on another instance takes effect there too.
+const messageScopeTTL = time.Minute
+
+var messageScopes struct {
+	sync.RWMutex
+	ids      map[string]uint
+	loadedAt time.Time
+}
+
+// ReloadMessageScopes rebuilds the scope map from the table.
+func ReloadMessageScopes() error {
+	var rows []MessageScope
+	if err := database.DB.Find(&rows).Error; err != nil {
+		return err
+	}
+	ids := make(map[string]uint, len(rows))
+	for _, r := range rows {
+		ids[r.Name] = r.MessageID
+	}
+	messageScopes.Lock()
+	defer messageScopes.Unlock()
+	messageScopes.ids = ids
+	messageScopes.loadedAt = time.Now()
+	return nil
+}
+
+// messageScopeID returns the message ID of the scope.
+func messageScopeID(scope string) (uint, bool) {
+	messageScopes.RLock()
+	stale := time.Since(messageScopes.loadedAt) > messageScopeTTL
+	messageScopes.RUnlock()
+	if stale {
+		if err := ReloadMessageScopes(); err != nil {
+			// 読み直せなければ手元の対応表を使い続ける
+			log.Printf("Error reloading message scopes: %v", err)
+		}
+	}
+	messageScopes.RLock()
+	defer messageScopes.RUnlock()
+	id, ok := messageScopes.ids[scope]
+	return id, ok
+}
+
+// GetMessageScopes returns all scopes by name.
+func GetMessageScopes() ([]MessageScope, error) {
+	var scopes []MessageScope
+	err := database.DB.Order("name ASC").Find(&scopes).Error
+	return scopes, err
+}
+
+// SetMessageScope points the scope at the message, creating the scope if
+// needed, and rebuilds the scope map.
+func SetMessageScope(name string, messageID uint) (*MessageScope, error) {
+	if name == "" {
+		return nil, errors.New("scope name is required")
+	}
+	if _, err := FindMessageByID(messageID); err != nil {
+		return nil, fmt.Errorf("message %d: %w", messageID, err)
+	}
+	var scope MessageScope
+	err := database.DB.Where("name = ?", name).First(&scope).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	scope.Name = name
+	scope.MessageID = messageID
+	if err := database.DB.Save(&scope).Error; err != nil {
+		return nil, err
+	}
+	return &scope, ReloadMessageScopes()
+}
+
+// CheckMessageScopes reports the scopes the code needs that are missing or
+// point to a message that does not exist.
+func CheckMessageScopes() error {
+	if err := ReloadMessageScopes(); err != nil {
+		return err
+	}
+	var problems []string
+	for _, name := range RequiredMessageScopeNames() {
+		id, ok := messageScopeID(name)
+		if !ok {
+			problems = append(problems, name+": not assigned")
+			continue
+		}
+		if _, err := FindMessageByID(id); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: message %d not found", name, id))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("message scopes: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// RequiredMessageScopeNames returns the scopes the code needs, sorted.
+func RequiredMessageScopeNames() []string {
+	names := make([]string, 0, len(requiredMessageScopes))
+	for name := range requiredMessageScopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seedMessageScopes fills an empty table with the required scopes, pointing
+// to the messages they were hard-coded to.
+func seedMessageScopes() error {
+	var count int64
+	if err := database.DB.Model(&MessageScope{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		scopes := make([]MessageScope, 0, len(requiredMessageScopes))
+		for _, name := range RequiredMessageScopeNames() {
+			scopes = append(scopes, MessageScope{Name: name, MessageID: requiredMessageScopes[name]})
+		}
+		if err := database.DB.Create(&scopes).Error; err != nil {
+			return err
+		}
+	}
+	return ReloadMessageScopes()
+}
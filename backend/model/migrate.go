@@ -0,0 +1,80 @@
+package model
+
+import (
+	"github.com/RyokouKanai/gomethod/database"
+)
+
+// Migrate applies the schema changes owned by the Go backend.
+// Tables inherited from the Rails app only ever get new columns added;
+// existing columns are left exactly as they are.
+func Migrate() error {
+	if err := addColumns(&User{}, "FollowState", "FollowedAt", "UnfollowedAt", "RichMenuID"); err != nil {
+		return err
+	}
+	if err := addColumns(&ReplyPattern{}, "InputTypes"); err != nil {
+		return err
+	}
+	if err := addColumns(&Happiness{}, "AudioURL"); err != nil {
+		return err
+	}
+	if err := addColumns(&BatchExecutionHistory{}, "RunDate"); err != nil {
+		return err
+	}
+	if err := addIndexes(&BatchExecutionHistory{}, "idx_batch_run_date"); err != nil {
+		return err
+	}
+	if err := database.DB.AutoMigrate(
+		&WebhookEvent{},
+		&BatchRun{},
+		&BatchSchedule{},
+		&BatchScheduleLock{},
+		&SendFailure{},
+		&AudienceSegment{},
+		&ScheduledBroadcast{},
+		&OutboxMessage{},
+		&RichMenu{},
+		&ReplyContinuation{},
+		&ReplyFallback{},
+		&MessageScope{},
+	); err != nil {
+		return err
+	}
+	if err := seedMessageScopes(); err != nil {
+		return err
+	}
+	if err := seedAttachReplyPatterns(); err != nil {
+		return err
+	}
+	if err := seedBroadcastFlow(); err != nil {
+		return err
+	}
+	return seedAudienceSegments()
+}
+
+// addColumns adds the given struct fields to the model's table if they are missing.
+func addColumns(model interface{}, fields ...string) error {
+	m := database.DB.Migrator()
+	for _, f := range fields {
+		if m.HasColumn(model, f) {
+			continue
+		}
+		if err := m.AddColumn(model, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addIndexes creates the given indexes declared on the model if they are missing.
+func addIndexes(model interface{}, names ...string) error {
+	m := database.DB.Migrator()
+	for _, name := range names {
+		if m.HasIndex(model, name) {
+			continue
+		}
+		if err := m.CreateIndex(model, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
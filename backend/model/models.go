@@ -78,40 +78,52 @@ func (MoonPhase) TableName() string { return "moon_phases" }
 
 // GetMoonPhaseToday returns today's moon phase, if any.
 func GetMoonPhaseToday() *MoonPhase {
-	var mp MoonPhase
-	today := time.Now().Format("2006-01-02")
-	if err := database.DB.Where("date = ?", today).First(&mp).Error; err != nil {
-		return nil
-	}
-	return &mp
+	return GetMoonPhaseOn(time.Now())
 }
 
 // GetMoonPhaseTomorrow returns tomorrow's moon phase, if any.
 func GetMoonPhaseTomorrow() *MoonPhase {
+	return GetMoonPhaseOn(time.Now().AddDate(0, 0, 1))
+}
+
+// GetMoonPhaseOn returns the moon phase on the given date in Japan, if any.
+func GetMoonPhaseOn(date time.Time) *MoonPhase {
 	var mp MoonPhase
-	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
-	if err := database.DB.Where("date = ?", tomorrow).First(&mp).Error; err != nil {
+	if err := database.DB.Where("date = ?", BatchRunDate(date).Format("2006-01-02")).First(&mp).Error; err != nil {
 		return nil
 	}
 	return &mp
 }
 
 // BatchExecutionHistory tracks batch execution for deduplication.
+// Each run claims a row for its (batch, run_date); rows from the Rails app
+// have no run_date.
 type BatchExecutionHistory struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Batch     string    `gorm:"column:batch" json:"batch"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Batch     string     `gorm:"column:batch;uniqueIndex:idx_batch_run_date" json:"batch"`
+	RunDate   *time.Time `gorm:"column:run_date;type:date;uniqueIndex:idx_batch_run_date" json:"run_date"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
 }
 
 func (BatchExecutionHistory) TableName() string { return "batch_execution_histories" }
 
-// IsToday checks if the batch was already executed today.
-func (b *BatchExecutionHistory) IsToday() bool {
-	now := time.Now()
-	bod := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	eod := bod.Add(24 * time.Hour)
-	return b.UpdatedAt.After(bod) && b.UpdatedAt.Before(eod)
+// Tokyo is the time zone the service runs in: batch run dates and the send
+// times admins enter are counted in it.
+var Tokyo = loadLocation("Asia/Tokyo", 9*60*60)
+
+func loadLocation(name string, offset int) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.FixedZone(name, offset)
+	}
+	return loc
+}
+
+// BatchRunDate returns the run date of a batch started at t, in Asia/Tokyo.
+func BatchRunDate(t time.Time) time.Time {
+	t = t.In(Tokyo)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, Tokyo)
 }
 
 // Option represents selectable options for a message.
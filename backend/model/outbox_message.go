@@ -0,0 +1,246 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/RyokouKanai/gomethod/encrypt"
+	"gorm.io/gorm"
+)
+
+// Outbox message states.
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// maxOutboxRecipients is LINE's limit of user IDs per multicast request.
+const maxOutboxRecipients = 500
+
+// OutboxMessage is an outgoing push, multicast or broadcast waiting to be
+// delivered by the outbox dispatcher. It is written in the same transaction
+// as the state change it belongs to, so a crash cannot leave one without the
+// other. Source ties the message to what queued it (a batch run ID, or
+// "broadcast-..." for admin broadcasts) and is used as the send failure
+// group when delivery finally fails. The message is stored encrypted once
+// queued and cleared when LINE accepts it.
+type OutboxMessage struct {
+	ID         uint    `gorm:"primaryKey" json:"id"`
+	Source     string  `gorm:"column:source;size:64;not null;index" json:"source"`
+	Kind       string  `gorm:"column:kind;size:16;not null" json:"kind"`
+	Recipients string  `gorm:"column:recipients;type:text" json:"recipients"`
+	Message    string  `gorm:"column:message;type:text;not null" json:"-"`
+	Salt       *string `gorm:"column:salt" json:"-"`
+	// RetryKey is sent on every attempt, so LINE delivers the message at most once.
+	RetryKey string `gorm:"column:retry_key;size:36;not null" json:"retry_key"`
+	// NotifyLineUserID is told when delivery finally fails, e.g. the admin who sent a broadcast.
+	NotifyLineUserID string     `gorm:"column:notify_line_user_id;size:64" json:"notify_line_user_id,omitempty"`
+	Status           string     `gorm:"column:status;size:16;not null;default:pending;index:idx_outbox_status_next" json:"status"`
+	NextAttemptAt    time.Time  `gorm:"column:next_attempt_at;not null;index:idx_outbox_status_next" json:"next_attempt_at"`
+	Attempts         int        `gorm:"column:attempts;not null;default:0" json:"attempts"`
+	StatusCode       int        `gorm:"column:status_code" json:"status_code"`
+	RequestID        string     `gorm:"column:request_id;size:64" json:"request_id"`
+	LastError        string     `gorm:"column:last_error;type:text" json:"last_error"`
+	SentAt           *time.Time `gorm:"column:sent_at" json:"sent_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+func (OutboxMessage) TableName() string { return "outbox_messages" }
+
+// NewOutboxBroadcast returns a broadcast to all friends.
+func NewOutboxBroadcast(source, message string) *OutboxMessage {
+	return newOutboxMessage(source, delivery.KindBroadcast, nil, message)
+}
+
+// NewOutboxPush returns a push to one user.
+func NewOutboxPush(source, lineUserID, message string) *OutboxMessage {
+	return newOutboxMessage(source, delivery.KindPush, []string{lineUserID}, message)
+}
+
+// NewOutboxMulticast returns multicasts to the given users, one per
+// LINE request so each chunk is retried on its own.
+func NewOutboxMulticast(source, message string, lineUserIDs []string) []*OutboxMessage {
+	var msgs []*OutboxMessage
+	for i := 0; i < len(lineUserIDs); i += maxOutboxRecipients {
+		end := i + maxOutboxRecipients
+		if end > len(lineUserIDs) {
+			end = len(lineUserIDs)
+		}
+		msgs = append(msgs, newOutboxMessage(source, delivery.KindMulticast, lineUserIDs[i:end], message))
+	}
+	return msgs
+}
+
+// NewOutboxResend returns a message that repeats a failed request to the
+// recipients that missed it, with the request's original retry key. If LINE
+// accepted the first attempt after all, it is not delivered twice.
+func NewOutboxResend(source, kind string, lineUserIDs []string, message, retryKey string) *OutboxMessage {
+	m := newOutboxMessage(source, kind, lineUserIDs, message)
+	m.RetryKey = retryKey
+	return m
+}
+
+func newOutboxMessage(source, kind string, to []string, message string) *OutboxMessage {
+	m := &OutboxMessage{
+		Source:        source,
+		Kind:          kind,
+		Message:       message,
+		RetryKey:      delivery.NewRetryKey(),
+		Status:        OutboxPending,
+		NextAttemptAt: time.Now(),
+	}
+	if len(to) > 0 {
+		b, _ := json.Marshal(to)
+		m.Recipients = string(b)
+	}
+	return m
+}
+
+// RecipientIDs returns the LINE user IDs the message is addressed to.
+// It is empty for broadcasts.
+func (m *OutboxMessage) RecipientIDs() []string {
+	var ids []string
+	if m.Recipients != "" {
+		json.Unmarshal([]byte(m.Recipients), &ids)
+	}
+	return ids
+}
+
+// PlainMessage returns the decrypted message. Rows queued before messages
+// were encrypted are returned as they are.
+func (m *OutboxMessage) PlainMessage() (string, error) {
+	if m.Salt == nil {
+		return m.Message, nil
+	}
+	return encrypt.Decrypt(m.Message, *m.Salt)
+}
+
+// QueueOutboxMessages encrypts the messages and writes them to the outbox.
+// Pass the transaction of the state change they belong to; nil uses
+// database.DB.
+func QueueOutboxMessages(tx *gorm.DB, msgs ...*OutboxMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	for _, m := range msgs {
+		if m.Salt != nil {
+			continue
+		}
+		enc, salt, err := encrypt.Encrypt(m.Message)
+		if err != nil {
+			return err
+		}
+		m.Message = enc
+		m.Salt = &salt
+	}
+	if tx == nil {
+		tx = database.DB
+	}
+	return tx.Create(msgs).Error
+}
+
+// ClaimOutboxMessages takes up to limit messages that are due, moving them to
+// sending. Messages left sending since staleBefore (the instance stopped
+// mid-send) are taken again; their retry key keeps LINE from delivering twice.
+func ClaimOutboxMessages(limit int, staleBefore time.Time) ([]OutboxMessage, error) {
+	var candidates []OutboxMessage
+	err := database.DB.
+		Where("(status = ? AND next_attempt_at <= ?) OR (status = ? AND updated_at < ?)",
+			OutboxPending, time.Now(), OutboxSending, staleBefore).
+		Order("id ASC").Limit(limit).Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []OutboxMessage
+	for _, m := range candidates {
+		// 他のインスタンスが先に取った場合は更新されない
+		result := database.DB.Model(&OutboxMessage{}).
+			Where("id = ? AND status = ? AND updated_at = ?", m.ID, m.Status, m.UpdatedAt).
+			Updates(map[string]interface{}{
+				"status":     OutboxSending,
+				"attempts":   gorm.Expr("attempts + 1"),
+				"updated_at": time.Now(),
+			})
+		if result.Error != nil {
+			return claimed, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		m.Status = OutboxSending
+		m.Attempts++
+		claimed = append(claimed, m)
+	}
+	return claimed, nil
+}
+
+// MarkSent records that LINE accepted the message and clears it, since it
+// won't be sent again.
+func (m *OutboxMessage) MarkSent(statusCode int, requestID string) error {
+	now := time.Now()
+	m.Status = OutboxSent
+	m.Message = ""
+	m.Salt = nil
+	m.StatusCode = statusCode
+	m.RequestID = requestID
+	m.LastError = ""
+	m.SentAt = &now
+	return database.DB.Save(m).Error
+}
+
+// MarkRetry records a failed attempt and schedules the next one.
+func (m *OutboxMessage) MarkRetry(statusCode int, requestID, errMsg string, next time.Time) error {
+	m.Status = OutboxPending
+	m.StatusCode = statusCode
+	m.RequestID = requestID
+	m.LastError = errMsg
+	m.NextAttemptAt = next
+	return database.DB.Save(m).Error
+}
+
+// MarkFailed records that the message will not be attempted again.
+func (m *OutboxMessage) MarkFailed(statusCode int, requestID, errMsg string) error {
+	m.Status = OutboxFailed
+	m.StatusCode = statusCode
+	m.RequestID = requestID
+	m.LastError = errMsg
+	return database.DB.Save(m).Error
+}
+
+// GetOutboxMessages returns the newest outbox messages, optionally filtered
+// by source and status.
+func GetOutboxMessages(source, status string, limit int) ([]OutboxMessage, error) {
+	q := database.DB.Order("id DESC").Limit(limit)
+	if source != "" {
+		q = q.Where("source = ?", source)
+	}
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var msgs []OutboxMessage
+	err := q.Find(&msgs).Error
+	return msgs, err
+}
+
+// FindOutboxMessageByID finds an outbox message by ID.
+func FindOutboxMessageByID(id uint) *OutboxMessage {
+	var m OutboxMessage
+	if err := database.DB.First(&m, id).Error; err != nil {
+		return nil
+	}
+	return &m
+}
+
+// PurgeOutboxMessages deletes sent and given-up messages last updated before
+// the given time. Pending and sending ones are kept until they finish.
+func PurgeOutboxMessages(before time.Time) (int64, error) {
+	result := database.DB.Where("status IN ? AND updated_at < ?", []string{OutboxSent, OutboxFailed}, before).
+		Delete(&OutboxMessage{})
+	return result.RowsAffected, result.Error
+}
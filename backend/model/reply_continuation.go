@@ -0,0 +1,82 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/encrypt"
+	"gorm.io/gorm"
+)
+
+// ReplyContinuation holds the messages of a reply that did not fit in LINE's
+// five messages, until the user taps "続きを読む". Each user has at most one:
+// starting a new reply replaces what was left of the previous one.
+type ReplyContinuation struct {
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	LineUserID string `gorm:"column:line_user_id;size:64;not null;index" json:"line_user_id"`
+	// Messages is the JSON array of the remaining LINE message objects,
+	// encrypted since they can hold the user's own entries.
+	Messages  string    `gorm:"column:messages;type:mediumtext;not null" json:"-"`
+	Salt      *string   `gorm:"column:salt" json:"-"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (ReplyContinuation) TableName() string { return "reply_continuations" }
+
+// ReplyContinuationTTL is how long the rest of a reply can still be read.
+const ReplyContinuationTTL = 24 * time.Hour
+
+// PlainMessages returns the decrypted messages.
+func (c *ReplyContinuation) PlainMessages() (string, error) {
+	if c.Salt == nil {
+		return c.Messages, nil
+	}
+	return encrypt.Decrypt(c.Messages, *c.Salt)
+}
+
+// ReplaceReplyContinuation saves the rest of a reply to the user, dropping
+// any continuation they had not read.
+func ReplaceReplyContinuation(lineUserID, messages string) (*ReplyContinuation, error) {
+	enc, salt, err := encrypt.Encrypt(messages)
+	if err != nil {
+		return nil, err
+	}
+	c := &ReplyContinuation{LineUserID: lineUserID, Messages: enc, Salt: &salt}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("line_user_id = ?", lineUserID).Delete(&ReplyContinuation{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(c).Error
+	})
+	return c, err
+}
+
+// TakeReplyContinuation returns the user's continuation and deletes it, so
+// tapping the button twice sends the rest once. It returns nil if the
+// continuation was already read, replaced or is older than since.
+func TakeReplyContinuation(id uint, lineUserID string, since time.Time) (*ReplyContinuation, error) {
+	var c ReplyContinuation
+	err := database.DB.Where("id = ? AND line_user_id = ? AND created_at >= ?", id, lineUserID, since).First(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := database.DB.Delete(&c)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// PurgeReplyContinuations deletes continuations created before the given
+// time, which can no longer be read.
+func PurgeReplyContinuations(before time.Time) (int64, error) {
+	result := database.DB.Where("created_at < ?", before).Delete(&ReplyContinuation{})
+	return result.RowsAffected, result.Error
+}
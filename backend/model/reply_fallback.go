@@ -0,0 +1,70 @@
+package model
+
+import (
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+)
+
+// Outcomes of a reply whose token LINE rejected.
+const (
+	ReplyFallbackPushed     = "pushed"
+	ReplyFallbackPushFailed = "push_failed"
+	// ReplyFallbackDisabled: REPLY_FALLBACK is off, the reply was dropped.
+	ReplyFallbackDisabled = "disabled"
+	// ReplyFallbackQuota: too little of the monthly quota was left to push.
+	ReplyFallbackQuota = "quota"
+	// ReplyFallbackNoUser: the reply was not tied to a user to push to.
+	ReplyFallbackNoUser = "no_user"
+)
+
+// ReplyFallback records a reply LINE rejected because its token had expired
+// or was used, and whether it was pushed instead. Pushes are paid, so this
+// shows what slow handling and redelivered events cost.
+type ReplyFallback struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	LineUserID   string    `gorm:"column:line_user_id;size:64" json:"line_user_id"`
+	Outcome      string    `gorm:"column:outcome;size:16;not null;index:idx_reply_fallback_outcome_created" json:"outcome"`
+	MessageCount int       `gorm:"column:message_count;not null" json:"message_count"`
+	ReplyError   string    `gorm:"column:reply_error;type:text" json:"reply_error"`
+	StatusCode   int       `gorm:"column:status_code" json:"status_code"`
+	RequestID    string    `gorm:"column:request_id;size:64" json:"request_id"`
+	Error        string    `gorm:"column:error;type:text" json:"error"`
+	CreatedAt    time.Time `gorm:"index:idx_reply_fallback_outcome_created" json:"created_at"`
+}
+
+func (ReplyFallback) TableName() string { return "reply_fallbacks" }
+
+// CreateReplyFallback records a reply fallback.
+func CreateReplyFallback(f *ReplyFallback) error {
+	return database.DB.Create(f).Error
+}
+
+// ReplyFallbackCount is the number of fallbacks with one outcome.
+type ReplyFallbackCount struct {
+	Outcome  string `json:"outcome"`
+	Count    int64  `json:"count"`
+	Messages int64  `json:"messages"`
+}
+
+// CountReplyFallbacks counts the fallbacks since the given time by outcome.
+func CountReplyFallbacks(since time.Time) ([]ReplyFallbackCount, error) {
+	var counts []ReplyFallbackCount
+	err := database.DB.Model(&ReplyFallback{}).
+		Select("outcome, COUNT(*) AS count, COALESCE(SUM(message_count), 0) AS messages").
+		Where("created_at >= ?", since).
+		Group("outcome").Order("outcome").
+		Scan(&counts).Error
+	return counts, err
+}
+
+// GetReplyFallbacks returns the latest fallbacks, newest first.
+func GetReplyFallbacks(outcome string, limit int) ([]ReplyFallback, error) {
+	var fallbacks []ReplyFallback
+	q := database.DB.Order("id DESC").Limit(limit)
+	if outcome != "" {
+		q = q.Where("outcome = ?", outcome)
+	}
+	err := q.Find(&fallbacks).Error
+	return fallbacks, err
+}
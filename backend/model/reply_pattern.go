@@ -1,19 +1,48 @@
 package model
 
 import (
+	"strings"
+
 	"github.com/RyokouKanai/gomethod/database"
 )
 
+// Input types of messages a user can send (LINE message types).
+const (
+	InputTypeText     = "text"
+	InputTypeImage    = "image"
+	InputTypeVideo    = "video"
+	InputTypeAudio    = "audio"
+	InputTypeFile     = "file"
+	InputTypeLocation = "location"
+	InputTypeSticker  = "sticker"
+)
+
 type ReplyPattern struct {
 	ID              uint   `gorm:"primaryKey" json:"id"`
 	SentMessageID   uint   `gorm:"column:sent_message_id" json:"sent_message_id"`
 	Position        *int   `gorm:"column:position" json:"position"`
 	NextMessageID   uint   `gorm:"column:next_message_id" json:"next_message_id"`
 	ExecutionMethod string `gorm:"column:execution_method;default:base" json:"execution_method"`
+	// InputTypes is a comma-separated list of the input types the pattern
+	// accepts, e.g. "text" or "sticker". Empty means text only.
+	InputTypes string `gorm:"column:input_types;size:255;not null;default:text" json:"input_types"`
 }
 
 func (ReplyPattern) TableName() string { return "reply_patterns" }
 
+// Accepts reports whether the pattern accepts input of the given type.
+func (rp *ReplyPattern) Accepts(inputType string) bool {
+	if rp.InputTypes == "" {
+		return inputType == InputTypeText
+	}
+	for _, t := range strings.Split(rp.InputTypes, ",") {
+		if strings.TrimSpace(t) == inputType {
+			return true
+		}
+	}
+	return false
+}
+
 // GetNextMessage returns the next message for this reply pattern.
 func (rp *ReplyPattern) GetNextMessage() *Message {
 	msg, _ := FindMessageByID(rp.NextMessageID)
@@ -45,12 +74,70 @@ func FindReplyPatternByMessageAndPosition(sentMessageID uint, position int) *Rep
 	return &rp
 }
 
-// FindFirstReplyPatternByMessage finds the first reply pattern for a sent message.
+// FindFirstReplyPatternByMessage finds the first reply pattern for a sent
+// message that accepts text.
 func FindFirstReplyPatternByMessage(sentMessageID uint) *ReplyPattern {
-	var rp ReplyPattern
-	err := database.DB.Where("sent_message_id = ?", sentMessageID).First(&rp).Error
-	if err != nil {
+	return FindReplyPatternByMessageAndInputType(sentMessageID, InputTypeText)
+}
+
+// FindReplyPatternByMessageAndInputType finds the first reply pattern for a
+// sent message that accepts the given input type.
+func FindReplyPatternByMessageAndInputType(sentMessageID uint, inputType string) *ReplyPattern {
+	var patterns []ReplyPattern
+	if err := database.DB.Where("sent_message_id = ?", sentMessageID).Order("id ASC").Find(&patterns).Error; err != nil {
 		return nil
 	}
-	return &rp
+	for i := range patterns {
+		if patterns[i].Accepts(inputType) {
+			return &patterns[i]
+		}
+	}
+	return nil
+}
+
+// attachReplyPatterns are the actions that attach media to what the user
+// just created, by the action that created it.
+var attachReplyPatterns = []struct {
+	after, method, inputType string
+}{
+	{"dream_wishes_create", "dream_wishes_attach_image", InputTypeImage},
+	{"solution_wishes_create", "solution_wishes_attach_image", InputTypeImage},
+	{"happiness_create", "happiness_attach_audio", InputTypeAudio},
+}
+
+// seedAttachReplyPatterns lets the user send a photo or voice note right
+// after creating a wish or happiness: at the message shown after the create
+// action, input of the media type runs the attach action and shows that
+// message again. Actions that already have a pattern are left alone.
+func seedAttachReplyPatterns() error {
+	for _, a := range attachReplyPatterns {
+		var count int64
+		if err := database.DB.Model(&ReplyPattern{}).Where("execution_method = ?", a.method).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		var creates []ReplyPattern
+		if err := database.DB.Where("execution_method = ?", a.after).Find(&creates).Error; err != nil {
+			return err
+		}
+		seen := map[uint]bool{}
+		for _, c := range creates {
+			if seen[c.NextMessageID] {
+				continue
+			}
+			seen[c.NextMessageID] = true
+			rp := ReplyPattern{
+				SentMessageID:   c.NextMessageID,
+				NextMessageID:   c.NextMessageID,
+				ExecutionMethod: a.method,
+				InputTypes:      a.inputType,
+			}
+			if err := database.DB.Create(&rp).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
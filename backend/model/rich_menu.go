@@ -0,0 +1,108 @@
+package model
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+)
+
+// RichMenu is a rich menu definition synced to LINE. Definitions are kept in
+// config/rich_menus.json; cmd/richmenu mirrors them here and uploads the ones
+// whose checksum changed, bumping Version.
+//
+// A user gets the first menu, by Position, whose rules match them. Empty
+// rules match everyone. The Default menu is LINE's default rich menu, so its
+// users need no per-user link.
+type RichMenu struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	Name        string `gorm:"column:name;size:64;not null;uniqueIndex" json:"name"`
+	Position    int    `gorm:"column:position;not null" json:"position"`
+	MemberTypes string `gorm:"column:member_types;size:255" json:"member_types"` // カンマ区切り
+	PlanIDs     string `gorm:"column:plan_ids;size:255" json:"plan_ids"`         // カンマ区切り
+	IsShik      *bool  `gorm:"column:is_shik" json:"is_shik"`
+	Default     bool   `gorm:"column:is_default;not null;default:false" json:"default"`
+	// Definition is the LINE rich menu object (size, chatBarText, areas) as JSON.
+	Definition string `gorm:"column:definition;type:text;not null" json:"definition"`
+	ImagePath  string `gorm:"column:image_path;size:255;not null" json:"image_path"`
+	// Checksum covers the definition and image, to tell when to upload again.
+	Checksum       string     `gorm:"column:checksum;size:64;not null" json:"checksum"`
+	Version        int        `gorm:"column:version;not null;default:0" json:"version"`
+	LineRichMenuID string     `gorm:"column:line_rich_menu_id;size:64" json:"line_rich_menu_id"`
+	SyncedAt       *time.Time `gorm:"column:synced_at" json:"synced_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (RichMenu) TableName() string { return "rich_menus" }
+
+// Matches reports whether the menu's rules match the user.
+func (m *RichMenu) Matches(u *User) bool {
+	if types := splitList(m.MemberTypes); len(types) > 0 && !slices.Contains(types, u.MemberType) {
+		return false
+	}
+	if ids := splitList(m.PlanIDs); len(ids) > 0 && !slices.Contains(ids, strconv.FormatInt(u.PlanID, 10)) {
+		return false
+	}
+	if m.IsShik != nil && *m.IsShik != u.IsShik {
+		return false
+	}
+	return true
+}
+
+// GetRichMenus returns the rich menus in matching order.
+func GetRichMenus() ([]RichMenu, error) {
+	var menus []RichMenu
+	err := database.DB.Order("position ASC, id ASC").Find(&menus).Error
+	return menus, err
+}
+
+// FindRichMenuByName finds a rich menu by name.
+func FindRichMenuByName(name string) *RichMenu {
+	var m RichMenu
+	if err := database.DB.Where("name = ?", name).First(&m).Error; err != nil {
+		return nil
+	}
+	return &m
+}
+
+// SaveRichMenu creates or updates the rich menu.
+func SaveRichMenu(m *RichMenu) error {
+	return database.DB.Save(m).Error
+}
+
+// DeleteRichMenu deletes the rich menu row.
+func DeleteRichMenu(m *RichMenu) error {
+	return database.DB.Delete(m).Error
+}
+
+// RichMenuFor returns the LINE rich menu ID the user should be linked to:
+// the first matching menu's, or "" for the default menu or no match.
+func RichMenuFor(menus []RichMenu, u *User) string {
+	for i := range menus {
+		if !menus[i].Matches(u) {
+			continue
+		}
+		if menus[i].Default {
+			return ""
+		}
+		return menus[i].LineRichMenuID
+	}
+	return ""
+}
+
+// UpdateRichMenuID records the rich menu the user is linked to ("" for the default).
+func (u *User) UpdateRichMenuID(richMenuID string) error {
+	u.RichMenuID = richMenuID
+	return database.DB.Model(u).UpdateColumn("rich_menu_id", richMenuID).Error
+}
+
+// GetUsersForRichMenuLinks returns a page of following users after the given
+// ID, for relinking rich menus in batches.
+func GetUsersForRichMenuLinks(afterID uint, limit int) ([]User, error) {
+	var users []User
+	err := database.DB.Where("id > ? AND follow_state = ?", afterID, FollowStateFollowing).
+		Order("id ASC").Limit(limit).Find(&users).Error
+	return users, err
+}
@@ -0,0 +1,150 @@
+package model
+
+import (
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/encrypt"
+	"gorm.io/gorm"
+)
+
+// Scheduled broadcast states.
+const (
+	ScheduledBroadcastPending   = "pending"
+	ScheduledBroadcastSending   = "sending"
+	ScheduledBroadcastSent      = "sent"
+	ScheduledBroadcastFailed    = "failed"
+	ScheduledBroadcastCancelled = "cancelled"
+)
+
+// ScheduledBroadcast is an admin broadcast waiting to be sent at SendAt by
+// the send_scheduled_broadcasts batch. The message is stored encrypted and
+// cleared once the broadcast is queued.
+type ScheduledBroadcast struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	AdminID        uint       `gorm:"column:admin_id;not null" json:"admin_id"`
+	SegmentID      uint       `gorm:"column:segment_id;not null" json:"segment_id"`
+	Message        string     `gorm:"column:message;type:text;not null" json:"-"`
+	Salt           *string    `gorm:"column:salt" json:"-"`
+	SendAt         time.Time  `gorm:"column:send_at;not null;index" json:"send_at"`
+	Status         string     `gorm:"column:status;size:16;not null;default:pending;index" json:"status"`
+	SentAt         *time.Time `gorm:"column:sent_at" json:"sent_at"`
+	RecipientCount int        `gorm:"column:recipient_count;not null;default:0" json:"recipient_count"`
+	FailedCount    int        `gorm:"column:failed_count;not null;default:0" json:"failed_count"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (ScheduledBroadcast) TableName() string { return "scheduled_broadcasts" }
+
+// PlainMessage returns the decrypted message. Broadcasts stored before
+// messages were encrypted are returned as they are.
+func (sb *ScheduledBroadcast) PlainMessage() (string, error) {
+	if sb.Salt == nil {
+		return sb.Message, nil
+	}
+	return encrypt.Decrypt(sb.Message, *sb.Salt)
+}
+
+// CreateScheduledBroadcast encrypts the message and stores a broadcast to be
+// sent later.
+func CreateScheduledBroadcast(adminID, segmentID uint, message string, sendAt time.Time) (*ScheduledBroadcast, error) {
+	enc, salt, err := encrypt.Encrypt(message)
+	if err != nil {
+		return nil, err
+	}
+	sb := &ScheduledBroadcast{
+		AdminID:   adminID,
+		SegmentID: segmentID,
+		Message:   enc,
+		Salt:      &salt,
+		SendAt:    sendAt,
+		Status:    ScheduledBroadcastPending,
+	}
+	return sb, database.DB.Create(sb).Error
+}
+
+// FindScheduledBroadcastByID finds a scheduled broadcast by ID.
+func FindScheduledBroadcastByID(id uint) *ScheduledBroadcast {
+	var sb ScheduledBroadcast
+	if err := database.DB.First(&sb, id).Error; err != nil {
+		return nil
+	}
+	return &sb
+}
+
+// GetPendingScheduledBroadcasts returns the broadcasts not yet sent, soonest first.
+func GetPendingScheduledBroadcasts() ([]ScheduledBroadcast, error) {
+	var broadcasts []ScheduledBroadcast
+	err := database.DB.Where("status = ?", ScheduledBroadcastPending).
+		Order("send_at ASC, id ASC").Find(&broadcasts).Error
+	return broadcasts, err
+}
+
+// unsentScheduledBroadcast are the states of a broadcast that has not been
+// queued. ClaimTx moves a broadcast to sending in the transaction that queues
+// it and records it sent, so a sending row has not been queued yet and is
+// sent like a pending one.
+var unsentScheduledBroadcast = []string{ScheduledBroadcastPending, ScheduledBroadcastSending}
+
+// GetDueScheduledBroadcasts returns the unsent broadcasts whose send time
+// is at or before the given time.
+func GetDueScheduledBroadcasts(now time.Time) ([]ScheduledBroadcast, error) {
+	var broadcasts []ScheduledBroadcast
+	err := database.DB.Where("status IN ? AND send_at <= ?", unsentScheduledBroadcast, now).
+		Order("send_at ASC, id ASC").Find(&broadcasts).Error
+	return broadcasts, err
+}
+
+// ClaimTx takes an unsent broadcast within the transaction that queues it,
+// so a crash before the commit leaves it pending. It returns false if the
+// broadcast was cancelled or another run already took it.
+func (sb *ScheduledBroadcast) ClaimTx(tx *gorm.DB) (bool, error) {
+	return sb.transitionTx(tx, unsentScheduledBroadcast, ScheduledBroadcastSending)
+}
+
+// Fail marks an unsent broadcast failed. A cancelled broadcast stays cancelled.
+func (sb *ScheduledBroadcast) Fail() error {
+	_, err := sb.transitionTx(database.DB, unsentScheduledBroadcast, ScheduledBroadcastFailed)
+	return err
+}
+
+// Cancel cancels a pending broadcast. It returns false if it is no longer pending.
+func (sb *ScheduledBroadcast) Cancel() (bool, error) {
+	return sb.transitionTx(database.DB, []string{ScheduledBroadcastPending}, ScheduledBroadcastCancelled)
+}
+
+func (sb *ScheduledBroadcast) transitionTx(tx *gorm.DB, from []string, to string) (bool, error) {
+	result := tx.Model(&ScheduledBroadcast{}).
+		Where("id = ? AND status IN ?", sb.ID, from).
+		Update("status", to)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	sb.Status = to
+	return true, nil
+}
+
+// Finish records the outcome of sending the broadcast.
+func (sb *ScheduledBroadcast) Finish(status string, recipients, failed int) error {
+	return sb.FinishTx(database.DB, status, recipients, failed)
+}
+
+// FinishTx is Finish within the given transaction, e.g. the one that queues
+// the broadcast in the outbox. The message of a sent broadcast is cleared,
+// since the outbox has its own copy.
+func (sb *ScheduledBroadcast) FinishTx(tx *gorm.DB, status string, recipients, failed int) error {
+	now := time.Now()
+	if status == ScheduledBroadcastSent {
+		sb.Message = ""
+		sb.Salt = nil
+	}
+	sb.Status = status
+	sb.SentAt = &now
+	sb.RecipientCount = recipients
+	sb.FailedCount = failed
+	return tx.Save(sb).Error
+}
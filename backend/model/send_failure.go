@@ -0,0 +1,125 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/encrypt"
+	"gorm.io/gorm"
+)
+
+// SendFailure is a message LINE did not accept, kept so it can be resent to
+// just the recipients that missed it. GroupID ties failures to what sent
+// them: a batch run ID, or "broadcast-..." for admin broadcasts. The message
+// is stored encrypted and cleared once its resend is queued.
+type SendFailure struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	GroupID    string     `gorm:"column:group_id;size:64;not null;index" json:"group_id"`
+	Kind       string     `gorm:"column:kind;size:16;not null;default:push" json:"kind"`
+	LineUserID string     `gorm:"column:line_user_id;size:64" json:"line_user_id"`
+	Message    string     `gorm:"column:message;type:text" json:"-"`
+	Salt       *string    `gorm:"column:salt" json:"-"`
+	RetryKey   string     `gorm:"column:retry_key;size:36" json:"retry_key"`
+	StatusCode int        `gorm:"column:status_code" json:"status_code"`
+	Error      string     `gorm:"column:error;type:text" json:"error"`
+	Attempts   int        `gorm:"column:attempts;not null;default:1" json:"attempts"`
+	ResentAt   *time.Time `gorm:"column:resent_at" json:"resent_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (SendFailure) TableName() string { return "send_failures" }
+
+// NewBroadcastFailureGroup returns a new failure group ID for a broadcast sent
+// by the given admin. Each admin's groups share a prefix, so they resend
+// only their own broadcasts.
+func NewBroadcastFailureGroup(adminID uint) string {
+	return fmt.Sprintf("%s%d", BroadcastFailureGroupPrefix(adminID), time.Now().UnixNano())
+}
+
+// BroadcastFailureGroupPrefix returns the failure group prefix of the admin's broadcasts.
+func BroadcastFailureGroupPrefix(adminID uint) string {
+	return fmt.Sprintf("broadcast-%d-", adminID)
+}
+
+// PlainMessage returns the decrypted message. Failures recorded before
+// messages were encrypted are returned as they are.
+func (f *SendFailure) PlainMessage() (string, error) {
+	if f.Salt == nil {
+		return f.Message, nil
+	}
+	return encrypt.Decrypt(f.Message, *f.Salt)
+}
+
+// CreateSendFailure encrypts the message and records a failed send.
+func CreateSendFailure(f *SendFailure) error {
+	enc, salt, err := encrypt.Encrypt(f.Message)
+	if err != nil {
+		return err
+	}
+	f.Message = enc
+	f.Salt = &salt
+	return database.DB.Create(f).Error
+}
+
+// GetSendFailures returns all failures of the group.
+func GetSendFailures(groupID string) ([]SendFailure, error) {
+	var failures []SendFailure
+	err := database.DB.Where("group_id = ?", groupID).Order("id ASC").Find(&failures).Error
+	return failures, err
+}
+
+// GetPendingSendFailures returns the failures of the group not yet resent.
+func GetPendingSendFailures(groupID string) ([]SendFailure, error) {
+	var failures []SendFailure
+	err := database.DB.Where("group_id = ? AND resent_at IS NULL", groupID).Order("id ASC").Find(&failures).Error
+	return failures, err
+}
+
+// FindLatestPendingSendFailureGroup returns the newest group with the given
+// prefix that still has failures to resend, or "" if there is none.
+func FindLatestPendingSendFailureGroup(prefix string) string {
+	var f SendFailure
+	err := database.DB.Where("group_id LIKE ? AND resent_at IS NULL", prefix+"%").
+		Order("id DESC").First(&f).Error
+	if err != nil {
+		return ""
+	}
+	return f.GroupID
+}
+
+// ErrSendFailureResent is returned when a failure was already queued for
+// resending by someone else.
+var ErrSendFailureResent = errors.New("send failure already resent")
+
+// QueueSendFailureResends writes the resends to the outbox and marks the
+// failures they cover as resent, clearing their messages, in one
+// transaction. A failure another resend already took rolls it all back with
+// ErrSendFailureResent, so nothing is queued twice.
+func QueueSendFailureResends(msgs []*OutboxMessage, failures []SendFailure) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := QueueOutboxMessages(tx, msgs...); err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, f := range failures {
+			result := tx.Model(&SendFailure{}).
+				Where("id = ? AND resent_at IS NULL", f.ID).
+				Updates(map[string]interface{}{
+					"resent_at": now,
+					"attempts":  gorm.Expr("attempts + 1"),
+					"message":   "",
+					"salt":      nil,
+				})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrSendFailureResent
+			}
+		}
+		return nil
+	})
+}
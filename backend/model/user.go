@@ -10,19 +10,30 @@ import (
 	"time"
 
 	"github.com/RyokouKanai/gomethod/database"
+	"gorm.io/gorm"
+)
+
+// Follow states of a user towards the LINE account.
+const (
+	FollowStateFollowing = "following"
+	FollowStateBlocked   = "blocked"
 )
 
 type User struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	LineUserID  string    `gorm:"column:line_user_id;not null" json:"line_user_id"`
-	MemberType  string    `gorm:"column:member_type;default:basic" json:"member_type"`
-	PlanID      int64     `gorm:"column:plan_id;default:1" json:"plan_id"`
-	DisplayName *string   `gorm:"column:display_name" json:"display_name"`
-	PictureURL  *string   `gorm:"column:picture_url" json:"picture_url"`
-	IsActive    bool      `gorm:"column:is_active;default:true" json:"is_active"`
-	IsShik      bool      `gorm:"column:is_shik;default:false" json:"is_shik"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	LineUserID   string     `gorm:"column:line_user_id;not null" json:"line_user_id"`
+	MemberType   string     `gorm:"column:member_type;default:basic" json:"member_type"`
+	PlanID       int64      `gorm:"column:plan_id;default:1" json:"plan_id"`
+	DisplayName  *string    `gorm:"column:display_name" json:"display_name"`
+	PictureURL   *string    `gorm:"column:picture_url" json:"picture_url"`
+	IsActive     bool       `gorm:"column:is_active;default:true" json:"is_active"`
+	IsShik       bool       `gorm:"column:is_shik;default:false" json:"is_shik"`
+	FollowState  string     `gorm:"column:follow_state;size:16;not null;default:following" json:"follow_state"`
+	FollowedAt   *time.Time `gorm:"column:followed_at" json:"followed_at"`
+	UnfollowedAt *time.Time `gorm:"column:unfollowed_at" json:"unfollowed_at"`
+	RichMenuID   string     `gorm:"column:rich_menu_id;size:64" json:"rich_menu_id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
 }
 
 func (User) TableName() string { return "users" }
@@ -31,6 +42,33 @@ func (u *User) IsAdmin() bool {
 	return u.MemberType == "admin"
 }
 
+// IsBlocked reports whether the user has blocked the LINE account.
+func (u *User) IsBlocked() bool {
+	return u.FollowState == FollowStateBlocked
+}
+
+// Follow marks the user as following (added or unblocked the account).
+func (u *User) Follow() error {
+	now := time.Now()
+	u.FollowState = FollowStateFollowing
+	u.FollowedAt = &now
+	return database.DB.Model(u).Updates(map[string]interface{}{
+		"follow_state": u.FollowState,
+		"followed_at":  u.FollowedAt,
+	}).Error
+}
+
+// Unfollow marks the user as having blocked the account.
+func (u *User) Unfollow() error {
+	now := time.Now()
+	u.FollowState = FollowStateBlocked
+	u.UnfollowedAt = &now
+	return database.DB.Model(u).Updates(map[string]interface{}{
+		"follow_state":  u.FollowState,
+		"unfollowed_at": u.UnfollowedAt,
+	}).Error
+}
+
 // FindOrCreateByLineUserID finds or creates a user by LINE user ID.
 func FindOrCreateByLineUserID(lineUserID string) (*User, error) {
 	var user User
@@ -44,6 +82,24 @@ func FindOrCreateByLineUserID(lineUserID string) (*User, error) {
 	return &user, nil
 }
 
+// FindUserByLineUserID finds a user by LINE user ID without creating one.
+func FindUserByLineUserID(lineUserID string) *User {
+	var u User
+	if err := database.DB.Where("line_user_id = ?", lineUserID).First(&u).Error; err != nil {
+		return nil
+	}
+	return &u
+}
+
+// FindUserByID finds a user by ID.
+func FindUserByID(id uint) *User {
+	var u User
+	if err := database.DB.First(&u, id).Error; err != nil {
+		return nil
+	}
+	return &u
+}
+
 // GetMasterUser returns the admin user.
 func GetMasterUser() (*User, error) {
 	var user User
@@ -53,19 +109,26 @@ func GetMasterUser() (*User, error) {
 	return &user, nil
 }
 
-// GetActiveUsers returns all active users.
+// GetActiveUsers returns all active users who have not blocked the account.
 func GetActiveUsers() ([]User, error) {
 	var users []User
-	if err := database.DB.Where("is_active = ?", true).Find(&users).Error; err != nil {
+	if err := database.DB.Where("is_active = ? AND follow_state = ?", true, FollowStateFollowing).Find(&users).Error; err != nil {
 		return nil, err
 	}
 	return users, nil
 }
 
-// GetShikUsers returns all shik users.
+// CountFollowingUsers returns the number of users who have not blocked the account.
+func CountFollowingUsers() (int64, error) {
+	var count int64
+	err := database.DB.Model(&User{}).Where("follow_state = ?", FollowStateFollowing).Count(&count).Error
+	return count, err
+}
+
+// GetShikUsers returns all shik users who have not blocked the account.
 func GetShikUsers() ([]User, error) {
 	var users []User
-	if err := database.DB.Where("is_shik = ?", true).Find(&users).Error; err != nil {
+	if err := database.DB.Where("is_shik = ? AND follow_state = ?", true, FollowStateFollowing).Find(&users).Error; err != nil {
 		return nil, err
 	}
 	return users, nil
@@ -234,32 +297,27 @@ func (u *User) GetGMessageHistoriesByPeriod(period string) ([]GMessageHistory, e
 
 // CreateGMessageHistory creates a new g_message_history entry.
 func (u *User) CreateGMessageHistory(gMessage *GMessage) error {
+	return u.CreateGMessageHistoryTx(database.DB, gMessage)
+}
+
+// CreateGMessageHistoryTx creates the g_message_history entry in the given
+// transaction, e.g. together with the outbox message that sends it.
+func (u *User) CreateGMessageHistoryTx(tx *gorm.DB, gMessage *GMessage) error {
 	h := GMessageHistory{
 		UserID:     u.ID,
 		GMessageID: gMessage.ID,
 	}
-	return database.DB.Create(&h).Error
+	return tx.Create(&h).Error
 }
 
 // FetchGMessageByPeriod fetches a random unsent g_message of the given period.
+// Once every message of the period has been sent, the histories are reset.
 func (u *User) FetchGMessageByPeriod(period string) (*GMessage, error) {
-	histories, err := u.GetGMessageHistoriesByPeriod(period)
+	leftMessages, sentIDs, err := u.unsentGMessagesByPeriod(period)
 	if err != nil {
 		return nil, err
 	}
 
-	sentIDs := make([]uint, 0, len(histories))
-	for _, h := range histories {
-		sentIDs = append(sentIDs, h.GMessageID)
-	}
-
-	var leftMessages []GMessage
-	query := database.DB.Where("period = ?", period)
-	if len(sentIDs) > 0 {
-		query = query.Where("id NOT IN ?", sentIDs)
-	}
-	query.Find(&leftMessages)
-
 	if len(leftMessages) == 0 {
 		// Reset histories for this period
 		if len(sentIDs) > 0 {
@@ -275,6 +333,47 @@ func (u *User) FetchGMessageByPeriod(period string) (*GMessage, error) {
 	return &leftMessages[rand.Intn(len(leftMessages))], nil
 }
 
+// PeekGMessagesByPeriod returns the g_messages FetchGMessageByPeriod would
+// pick from, without resetting any histories.
+func (u *User) PeekGMessagesByPeriod(period string) ([]GMessage, error) {
+	leftMessages, _, err := u.unsentGMessagesByPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+	if len(leftMessages) == 0 {
+		// 全て送信済みならリセット後と同じく全件が候補になる
+		database.DB.Where("period = ?", period).Find(&leftMessages)
+	}
+	if len(leftMessages) == 0 {
+		return nil, fmt.Errorf("no g_messages found for period: %s", period)
+	}
+	return leftMessages, nil
+}
+
+// unsentGMessagesByPeriod returns the g_messages of the period not yet sent,
+// along with the IDs of those already sent.
+func (u *User) unsentGMessagesByPeriod(period string) ([]GMessage, []uint, error) {
+	histories, err := u.GetGMessageHistoriesByPeriod(period)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sentIDs := make([]uint, 0, len(histories))
+	for _, h := range histories {
+		sentIDs = append(sentIDs, h.GMessageID)
+	}
+
+	var leftMessages []GMessage
+	query := database.DB.Where("period = ?", period)
+	if len(sentIDs) > 0 {
+		query = query.Where("id NOT IN ?", sentIDs)
+	}
+	if err := query.Find(&leftMessages).Error; err != nil {
+		return nil, nil, err
+	}
+	return leftMessages, sentIDs, nil
+}
+
 // SaveProfile fetches and saves the user's LINE profile.
 func (u *User) SaveProfile() error {
 	token := os.Getenv("LINE_CHANNEL_TOKEN")
@@ -106,12 +106,20 @@ type Happiness struct {
 	UserID    uint      `gorm:"column:user_id" json:"user_id"`
 	Content   *string   `gorm:"type:text" json:"content"`
 	Salt      *string   `gorm:"column:salt" json:"salt"`
+	AudioURL  *string   `gorm:"column:audio_url;type:text" json:"audio_url"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 func (Happiness) TableName() string { return "happiness" }
 
+func (hp *Happiness) GetAudioURL() string {
+	if hp.AudioURL != nil {
+		return *hp.AudioURL
+	}
+	return ""
+}
+
 func (hp *Happiness) PlainContent() string {
 	if hp.Content == nil || hp.Salt == nil {
 		if hp.Content != nil {
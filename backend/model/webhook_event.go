@@ -0,0 +1,134 @@
+package model
+
+import (
+	"time"
+
+	"github.com/RyokouKanai/gomethod/database"
+	"github.com/RyokouKanai/gomethod/encrypt"
+	"gorm.io/gorm/clause"
+)
+
+// Webhook event processing states.
+const (
+	WebhookEventPending = "pending" // persisted but not yet handed to a worker
+	WebhookEventQueued  = "queued"  // waiting in (or running on) a worker queue
+	WebhookEventDone    = "done"
+	WebhookEventFailed  = "failed"
+	// WebhookEventInterrupted means processing started but the instance shut
+	// down before it finished. These are not retried automatically, since
+	// part of the work (e.g. a push to some users) may already have happened.
+	WebhookEventInterrupted = "interrupted"
+)
+
+// WebhookEvent is a LINE webhook event persisted before it is processed.
+// The unique event ID keeps a redelivered event from being processed twice,
+// and the stored payload lets unfinished events be picked up again. The
+// payload holds what users sent, so it is stored encrypted and cleared once
+// the event is done or failed. Owner is the instance whose queue holds a
+// queued event.
+type WebhookEvent struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	EventID      string     `gorm:"column:event_id;size:64;not null;uniqueIndex" json:"event_id"`
+	IsRedelivery bool       `gorm:"column:is_redelivery" json:"is_redelivery"`
+	LineUserID   string     `gorm:"column:line_user_id;size:64" json:"line_user_id"`
+	Owner        string     `gorm:"column:owner;size:32" json:"owner"`
+	Payload      string     `gorm:"column:payload;type:text" json:"-"`
+	Salt         *string    `gorm:"column:salt" json:"-"`
+	Status       string     `gorm:"column:status;size:16;not null;default:pending;index" json:"status"`
+	ProcessedAt  *time.Time `gorm:"column:processed_at" json:"processed_at"`
+	CreatedAt    time.Time  `gorm:"index" json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+func (WebhookEvent) TableName() string { return "webhook_events" }
+
+// EncryptPayload encrypts the payload in place before it is saved.
+func (e *WebhookEvent) EncryptPayload() error {
+	enc, salt, err := encrypt.Encrypt(e.Payload)
+	if err != nil {
+		return err
+	}
+	e.Payload = enc
+	e.Salt = &salt
+	return nil
+}
+
+// PlainPayload returns the decrypted payload. Rows saved before payloads
+// were encrypted are returned as they are.
+func (e *WebhookEvent) PlainPayload() (string, error) {
+	if e.Salt == nil {
+		return e.Payload, nil
+	}
+	return encrypt.Decrypt(e.Payload, *e.Salt)
+}
+
+// ClaimWebhookEvent persists the event and reports whether this is the
+// first time it has been seen. The insert is atomic, so concurrent
+// deliveries of the same event cannot both claim it.
+func ClaimWebhookEvent(e *WebhookEvent) (bool, error) {
+	result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(e)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// UpdateWebhookEventStatus sets the processing status of an event. The
+// payload of a done or failed event is cleared, since it won't be replayed.
+func UpdateWebhookEventStatus(id uint, status string) error {
+	updates := map[string]interface{}{"status": status}
+	if status == WebhookEventDone || status == WebhookEventFailed || status == WebhookEventInterrupted {
+		updates["processed_at"] = time.Now()
+	}
+	if status == WebhookEventDone || status == WebhookEventFailed {
+		updates["payload"] = ""
+		updates["salt"] = nil
+	}
+	return database.DB.Model(&WebhookEvent{}).Where("id = ?", id).Updates(updates).Error
+}
+
+// DeleteWebhookEvent deletes the record of an event that was not accepted,
+// so that LINE's redelivery of it is not skipped as a duplicate.
+func DeleteWebhookEvent(id uint) error {
+	return database.DB.Delete(&WebhookEvent{}, id).Error
+}
+
+// FindStaleWebhookEvents returns unfinished events with the given status that
+// have not been touched since the given time, oldest first. Events owned by
+// exceptOwner are left out when it is set.
+func FindStaleWebhookEvents(status string, before time.Time, exceptOwner string, limit int) ([]WebhookEvent, error) {
+	var events []WebhookEvent
+	q := database.DB.Where("status = ? AND updated_at < ?", status, before)
+	if exceptOwner != "" {
+		q = q.Where("owner IS NULL OR owner <> ?", exceptOwner)
+	}
+	err := q.Order("id ASC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// RequeueWebhookEvent atomically moves a stale event back to queued on the
+// owner's queue. Returns false if another instance already picked it up.
+func RequeueWebhookEvent(e *WebhookEvent, owner string) (bool, error) {
+	result := database.DB.Model(&WebhookEvent{}).
+		Where("id = ? AND status = ? AND updated_at = ?", e.ID, e.Status, e.UpdatedAt).
+		Updates(map[string]interface{}{"status": WebhookEventQueued, "owner": owner, "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// PurgeWebhookEvents deletes event records older than the given time. It
+// returns how many were finished and how many never were: pending, queued
+// or interrupted events that old are dropped rather than replayed, since
+// their reply tokens and the conversation have long moved on.
+func PurgeWebhookEvents(before time.Time) (finished, unfinished int64, err error) {
+	terminal := []string{WebhookEventDone, WebhookEventFailed}
+	result := database.DB.Where("created_at < ? AND status IN ?", before, terminal).Delete(&WebhookEvent{})
+	if result.Error != nil {
+		return 0, 0, result.Error
+	}
+	finished = result.RowsAffected
+	result = database.DB.Where("created_at < ? AND status NOT IN ?", before, terminal).Delete(&WebhookEvent{})
+	return finished, result.RowsAffected, result.Error
+}
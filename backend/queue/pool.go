@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+var (
+	// ErrFull is returned by Submit when the worker for the key has no free capacity.
+	ErrFull = errors.New("queue: full")
+	// ErrClosed is returned by Submit after Shutdown has been called.
+	ErrClosed = errors.New("queue: closed")
+)
+
+// Pool runs jobs on a fixed set of workers. Jobs submitted with the same key
+// always go to the same worker, so they run one at a time in submission
+// order, while jobs for different keys run in parallel.
+type Pool struct {
+	name    string
+	workers []chan func()
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+
+	submitted *expvar.Int
+	rejected  *expvar.Int
+	processed *expvar.Int
+	panicked  *expvar.Int
+}
+
+// NewPool starts a pool of the given number of workers with a total queue
+// capacity split evenly between them. Metrics are published through expvar
+// under "queue_<name>".
+func NewPool(name string, workers, capacity int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	perWorker := capacity / workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+
+	p := &Pool{
+		name:      name,
+		workers:   make([]chan func(), workers),
+		submitted: new(expvar.Int),
+		rejected:  new(expvar.Int),
+		processed: new(expvar.Int),
+		panicked:  new(expvar.Int),
+	}
+	for i := range p.workers {
+		p.workers[i] = make(chan func(), perWorker)
+		p.wg.Add(1)
+		go p.run(p.workers[i])
+	}
+	p.publish()
+	return p
+}
+
+// Submit enqueues a job for the given key without blocking.
+func (p *Pool) Submit(key string, job func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.rejected.Add(1)
+		return ErrClosed
+	}
+
+	select {
+	case p.workers[p.index(key)] <- job:
+		p.submitted.Add(1)
+		return nil
+	default:
+		p.rejected.Add(1)
+		return ErrFull
+	}
+}
+
+// Depth returns the number of jobs waiting in the queues.
+func (p *Pool) Depth() int {
+	n := 0
+	for _, w := range p.workers {
+		n += len(w)
+	}
+	return n
+}
+
+// Shutdown stops accepting jobs and waits until the queued jobs have been
+// processed or the context is done.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, w := range p.workers {
+			close(w)
+		}
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Printf("Queue %s: %d jobs left undrained", p.name, p.Depth())
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) run(jobs chan func()) {
+	defer p.wg.Done()
+	for job := range jobs {
+		p.execute(job)
+	}
+}
+
+func (p *Pool) execute(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.panicked.Add(1)
+			log.Printf("Queue %s: job panicked: %v", p.name, r)
+		}
+	}()
+	job()
+	p.processed.Add(1)
+}
+
+func (p *Pool) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.workers)))
+}
+
+func (p *Pool) publish() {
+	m := new(expvar.Map).Init()
+	m.Set("submitted", p.submitted)
+	m.Set("rejected", p.rejected)
+	m.Set("processed", p.processed)
+	m.Set("panicked", p.panicked)
+	m.Set("depth", expvar.Func(func() interface{} { return p.Depth() }))
+	m.Set("workers", expvar.Func(func() interface{} { return len(p.workers) }))
+
+	name := "queue_" + p.name
+	if expvar.Get(name) == nil {
+		expvar.Publish(name, m)
+	}
+}
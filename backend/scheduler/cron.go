@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week) in a time zone.
+type Schedule struct {
+	Spec     string
+	Location *time.Location
+
+	minute, hour, dom, month, dow uint64
+	// 日と曜日の両方が指定された場合は cron と同じくどちらかに一致すれば実行する
+	domStar, dowStar bool
+}
+
+type bounds struct{ min, max int }
+
+var (
+	minuteBounds = bounds{0, 59}
+	hourBounds   = bounds{0, 23}
+	domBounds    = bounds{1, 31}
+	monthBounds  = bounds{1, 12}
+	dowBounds    = bounds{0, 7} // 0 と 7 はどちらも日曜
+)
+
+// Parse parses a cron expression such as "0 7 * * *" or "0 16 1,15 * *".
+// Each field accepts *, numbers, ranges (a-b), lists (a,b) and steps (*/n, a-b/n).
+// An empty tz means Asia/Tokyo, which is what the Cloud Scheduler jobs use.
+func Parse(spec, tz string) (*Schedule, error) {
+	if tz == "" {
+		tz = "Asia/Tokyo"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("time zone %q: %w", tz, err)
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	s := &Schedule{Spec: spec, Location: loc}
+	targets := []struct {
+		bits *uint64
+		b    bounds
+	}{
+		{&s.minute, minuteBounds},
+		{&s.hour, hourBounds},
+		{&s.dom, domBounds},
+		{&s.month, monthBounds},
+		{&s.dow, dowBounds},
+	}
+	for i, f := range fields {
+		bits, err := parseField(f, targets[i].b)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", spec, err)
+		}
+		*targets[i].bits = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	// Vixie cron と同じく "*/2" なども * として扱う
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := b.min, b.max
+		if rangePart != "*" {
+			var err error
+			if i := strings.Index(rangePart, "-"); i >= 0 {
+				if lo, err = strconv.Atoi(rangePart[:i]); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+				if hi, err = strconv.Atoi(rangePart[i+1:]); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else {
+				if lo, err = strconv.Atoi(rangePart); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+				hi = lo
+				if step > 1 {
+					hi = b.max
+				}
+			}
+		}
+		if lo < b.min || hi > b.max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, b.min, b.max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after t that matches the schedule.
+// It returns the zero time if there is none within five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.Location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.Location)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domOK := s.dom&(1<<uint(t.Day())) != 0
+	dowOK := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
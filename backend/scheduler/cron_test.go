@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+		minutes []int // 空なら確認しない
+	}{
+		{spec: "0 7 * * *", minutes: []int{0}},
+		{spec: "*/20 * * * *", minutes: []int{0, 20, 40}},
+		{spec: "5/15 * * * *", minutes: []int{5, 20, 35, 50}},
+		{spec: "1,5-7,50-59/5 * * * *", minutes: []int{1, 5, 6, 7, 50, 55}},
+		{spec: "0 16 1,15 * *"},
+		{spec: "0 0 * * 7"},
+		{spec: "0 0 * * 0-6/2"},
+		{spec: "", wantErr: true},
+		{spec: "* * * *", wantErr: true},
+		{spec: "* * * * * *", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "* 24 * * *", wantErr: true},
+		{spec: "* * 0 * *", wantErr: true},
+		{spec: "* * 32 * *", wantErr: true},
+		{spec: "* * * 13 *", wantErr: true},
+		{spec: "* * * * 8", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "*/x * * * *", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "1-x * * * *", wantErr: true},
+		{spec: "a * * * *", wantErr: true},
+		{spec: "1,,2 * * * *", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec, "")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%q) succeeded, want error", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.spec, err)
+			}
+			if s.Location.String() != "Asia/Tokyo" {
+				t.Errorf("Location = %s, want Asia/Tokyo", s.Location)
+			}
+			if tt.minutes == nil {
+				return
+			}
+			var want uint64
+			for _, m := range tt.minutes {
+				want |= 1 << uint(m)
+			}
+			if s.minute != want {
+				t.Errorf("minutes = %b, want %b", s.minute, want)
+			}
+		})
+	}
+
+	if _, err := Parse("0 7 * * *", "Mars/Olympus"); err == nil {
+		t.Error("Parse accepted an unknown time zone")
+	}
+}
+
+func TestNext(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jst := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, tokyo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{name: "same day", spec: "0 7 * * *", from: jst("2026-10-17 06:59"), want: jst("2026-10-17 07:00")},
+		{name: "strictly after", spec: "0 7 * * *", from: jst("2026-10-17 07:00"), want: jst("2026-10-18 07:00")},
+		{name: "seconds are ignored", spec: "0 7 * * *", from: jst("2026-10-17 06:59").Add(59 * time.Second), want: jst("2026-10-17 07:00")},
+		{name: "every five minutes", spec: "*/5 * * * *", from: jst("2026-10-17 10:02"), want: jst("2026-10-17 10:05")},
+		{name: "hour range with step", spec: "0 9-17/4 * * *", from: jst("2026-10-17 10:00"), want: jst("2026-10-17 13:00")},
+		{name: "day list", spec: "0 8 1,15 * *", from: jst("2026-10-02 00:00"), want: jst("2026-10-15 08:00")},
+		{name: "weekdays", spec: "30 8 * * 1-5", from: jst("2026-10-17 09:00"), want: jst("2026-10-19 08:30")},
+		{name: "weekday 7 is Sunday", spec: "0 0 * * 7", from: jst("2026-10-17 10:00"), want: jst("2026-10-18 00:00")},
+		{name: "weekday 0 is Sunday", spec: "0 0 * * 0", from: jst("2026-10-17 10:00"), want: jst("2026-10-18 00:00")},
+		// 日と曜日が両方指定されていればどちらかに一致すればよい
+		{name: "day or weekday", spec: "0 0 13 * 5", from: jst("2026-11-01 00:00"), want: jst("2026-11-06 00:00")},
+		// * で始まる日は制限なしとみなし、曜日と両方に一致する日だけ
+		{name: "star-prefixed day and weekday", spec: "0 0 */2 * 1", from: jst("2026-11-01 00:00"), want: jst("2026-11-09 00:00")},
+		{name: "star-prefixed weekday and day", spec: "0 0 13 * */7", from: jst("2026-11-01 00:00"), want: jst("2026-12-13 00:00")},
+		// UTC では前日でも東京では翌日
+		{name: "Tokyo midnight from UTC", spec: "0 0 * * *", from: time.Date(2026, 10, 17, 15, 30, 0, 0, time.UTC), want: jst("2026-10-19 00:00")},
+		{name: "Tokyo new year", spec: "0 0 1 1 *", from: time.Date(2026, 12, 31, 15, 30, 0, 0, time.UTC), want: jst("2028-01-01 00:00")},
+		{name: "month rollover", spec: "0 8 31 * *", from: jst("2026-11-01 00:00"), want: jst("2026-12-31 08:00")},
+		{name: "never", spec: "0 0 30 2 *", from: jst("2026-10-17 00:00"), want: time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.spec, "Asia/Tokyo")
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.spec, err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSkipsBadEntries(t *testing.T) {
+	entries := resolve([]Entry{
+		{Name: "no_such_batch", Cron: "0 7 * * *"},
+		{Name: "purge_webhook_events", Cron: "not a cron"},
+		{Name: "purge_webhook_events", Cron: "0 4 * * *"},
+	})
+	if len(entries) != 1 {
+		t.Fatalf("resolve kept %d entries, want 1", len(entries))
+	}
+	if entries[0].Cron != "0 4 * * *" || entries[0].Schedule == nil {
+		t.Errorf("resolve kept %+v", entries[0])
+	}
+}
@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/batch"
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+// Entry is a batch with its schedule.
+type Entry struct {
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`
+	TimeZone string `json:"time_zone"`
+
+	Job      batch.Job `json:"-"`
+	Schedule *Schedule `json:"-"`
+}
+
+// LoadEntries reads the batch schedules from the JSON file named by
+// BATCH_SCHEDULE_FILE, or from the batch_schedules table when it is unset.
+func LoadEntries() ([]Entry, error) {
+	if path := os.Getenv("BATCH_SCHEDULE_FILE"); path != "" {
+		return LoadFile(path)
+	}
+
+	schedules, err := model.GetEnabledBatchSchedules()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(schedules))
+	for _, s := range schedules {
+		entries = append(entries, Entry{Name: s.Name, Cron: s.Cron, TimeZone: s.TimeZone})
+	}
+	return resolve(entries), nil
+}
+
+// LoadFile reads batch schedules from a JSON file containing a list of
+// {"name", "cron", "time_zone"} objects.
+func LoadFile(path string) ([]Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return resolve(entries), nil
+}
+
+// resolve looks up each entry's job and parses its cron expression. Entries
+// naming an unknown batch or with an invalid expression are logged and left
+// out, so one bad row does not stop the other batches.
+func resolve(entries []Entry) []Entry {
+	resolved := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		job, ok := batch.Lookup(e.Name)
+		if !ok {
+			log.Printf("Scheduler: skipping unknown batch %s", e.Name)
+			continue
+		}
+		s, err := Parse(e.Cron, e.TimeZone)
+		if err != nil {
+			log.Printf("Scheduler: skipping batch %s: %v", e.Name, err)
+			continue
+		}
+		e.Job = job
+		e.Schedule = s
+		resolved = append(resolved, e)
+	}
+	return resolved
+}
+
+// Enabled reports whether the in-process scheduler should run.
+// Production relies on Cloud Scheduler, so it is off unless SCHEDULER_ENABLED=true.
+func Enabled() bool {
+	return os.Getenv("SCHEDULER_ENABLED") == "true"
+}
+
+// Run fires batches on their schedules until ctx is done. Schedules are
+// reloaded every minute, so edits to batch_schedules take effect without a
+// restart. When several instances run the scheduler, a lock row per
+// (batch, scheduled time) makes sure only one of them fires.
+func Run(ctx context.Context) {
+	entries, err := LoadEntries()
+	if err != nil {
+		log.Printf("Scheduler: error loading schedules: %v", err)
+	}
+	log.Printf("Scheduler: started with %d schedules", len(entries))
+
+	last := time.Now()
+	for {
+		// 次の分の頭まで待つ
+		wait := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute))
+		select {
+		case <-ctx.Done():
+			log.Println("Scheduler: stopped")
+			return
+		case <-time.After(wait):
+		}
+
+		if reloaded, err := LoadEntries(); err != nil {
+			// 読み込みに失敗したら前回のスケジュールで続ける
+			log.Printf("Scheduler: error reloading schedules: %v", err)
+		} else {
+			entries = reloaded
+		}
+
+		now := time.Now()
+		for _, e := range entries {
+			// 前回の確認以降に予定時刻があれば 1 回だけ実行する
+			at := e.Schedule.Next(last)
+			if at.IsZero() || at.After(now) {
+				continue
+			}
+			fire(e, at)
+		}
+		last = now
+	}
+}
+
+func fire(e Entry, at time.Time) {
+	ok, err := model.ClaimScheduledBatch(e.Name, at)
+	if err != nil {
+		log.Printf("Scheduler: error claiming %s at %s: %v", e.Name, at.Format(time.RFC3339), err)
+		return
+	}
+	if !ok {
+		// 他のインスタンスが実行済み
+		return
+	}
+
+	run, err := batch.Start(e.Job, false)
+	if err != nil {
+		log.Printf("Scheduler: error starting %s: %v", e.Name, err)
+		return
+	}
+	log.Printf("Scheduler: started %s (run %s) scheduled at %s", e.Name, run.RunID, at.Format(time.RFC3339))
+}
@@ -44,7 +44,7 @@ func (s *BackService) execute() bool {
 		return s.executeForceBack()
 	}
 
-	s.sendService.Reply(nextMsg.ToFormattedText(), s.ReplyToken)
+	s.reply(nextMsg.ToFormattedText(), nextMsg)
 	newTH, err := s.createTalkHistory(nextMsg)
 	if err == nil && newTH != nil {
 		rpID := int(rp.ID)
@@ -68,7 +68,7 @@ func (s *BackService) executeForceBack() bool {
 	if topMsg == nil {
 		return false
 	}
-	s.sendService.Reply(topMsg.ToFormattedText(), s.ReplyToken)
+	s.reply(topMsg.ToFormattedText(), topMsg)
 	s.createTalkHistory(topMsg)
 	return true
 }
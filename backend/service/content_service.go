@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/storage"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// ContentService downloads user-sent content (images, ...) from LINE and
+// saves it to blob storage.
+type ContentService struct {
+	blob  *messaging_api.MessagingApiBlobAPI
+	store storage.BlobStore
+}
+
+// NewContentService creates a new ContentService backed by the default blob store.
+// LINE_API_DATA_ENDPOINT overrides the content API base URL, like
+// LINE_API_ENDPOINT does for sends.
+func NewContentService() *ContentService {
+	blob, err := messaging_api.NewMessagingApiBlobAPI(os.Getenv("LINE_CHANNEL_TOKEN"), lineBlobAPIOptions()...)
+	if err != nil {
+		log.Printf("Error creating LINE blob client: %v", err)
+		return &ContentService{store: storage.Default()}
+	}
+	return &ContentService{blob: blob, store: storage.Default()}
+}
+
+// SaveMessageContent stores the content of a LINE message and returns a
+// reference to it (see storage.Ref) to save with the record.
+func (s *ContentService) SaveMessageContent(user *model.User, messageID string) (string, error) {
+	if s.blob == nil {
+		return "", fmt.Errorf("LINE blob client is not available")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := s.blob.WithContext(ctx).GetMessageContent(messageID)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	key := storage.UserKeyPrefix(user.ID) + messageID + extensionFor(contentType)
+	if err := s.store.Put(ctx, key, contentType, resp.Body); err != nil {
+		return "", err
+	}
+	return storage.Ref(key), nil
+}
+
+func extensionFor(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	}
+	exts, _ := mime.ExtensionsByType(contentType)
+	if len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
@@ -1,7 +1,11 @@
 package service
 
 import (
+	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/RyokouKanai/gomethod/action"
 	"github.com/RyokouKanai/gomethod/model"
@@ -10,7 +14,9 @@ import (
 // EventService handles LINE webhook events.
 type EventService struct {
 	sendService    *SendService
+	contentService *ContentService
 	actionRegistry *action.Registry
+	richMenus      *RichMenuService
 }
 
 // NewEventService creates a new EventService.
@@ -18,33 +24,90 @@ func NewEventService() *EventService {
 	ss := NewSendService()
 	return &EventService{
 		sendService:    ss,
+		contentService: NewContentService(),
 		actionRegistry: action.NewRegistry(ss),
+		richMenus:      newRichMenuServiceOrNil(),
 	}
 }
 
-// HandleFollow handles a follow event (new user).
+// HandleFollow handles a follow event (new user or unblock).
 func (es *EventService) HandleFollow(lineUserID string) {
 	user, err := model.FindOrCreateByLineUserID(lineUserID)
 	if err != nil {
 		log.Printf("Error creating user: %v", err)
 		return
 	}
+	if err := user.Follow(); err != nil {
+		log.Printf("Error updating follow state: %v", err)
+	}
 	if err := user.SaveProfile(); err != nil {
 		log.Printf("Error saving profile: %v", err)
 	}
+	// ブロック中に会員種別が変わっていることがある
+	es.ensureRichMenu(user)
 }
 
-// HandleMessage handles a message event.
+// HandleUnfollow handles an unfollow event (the user blocked the account).
+// Users never seen before are ignored rather than created just to be
+// marked unfollowed.
+func (es *EventService) HandleUnfollow(lineUserID string) {
+	user := model.FindUserByLineUserID(lineUserID)
+	if user == nil {
+		log.Printf("Ignoring unfollow of unknown user %s", lineUserID)
+		return
+	}
+	if err := user.Unfollow(); err != nil {
+		log.Printf("Error updating follow state: %v", err)
+	}
+}
+
+// Input is a non-text message received from a user.
+type Input struct {
+	Type      string // one of the model.InputType* constants
+	MessageID string
+	Address   string // location
+	Latitude  float64
+	Longitude float64
+	Keywords  []string // sticker
+}
+
+// HandleMessage handles a text message event.
 func (es *EventService) HandleMessage(lineUserID, receivedMessage, replyToken string) {
 	user, err := model.FindOrCreateByLineUserID(lineUserID)
 	if err != nil {
 		log.Printf("Error finding user: %v", err)
 		return
 	}
+	es.handle(user, receivedMessage, model.InputTypeText, replyToken)
+}
+
+// HandleInput handles a non-text message (sticker, image, audio, location, ...).
+// If the reply pattern the user is at accepts the input type, the input is
+// turned into the received message the pattern's action expects: the
+// pattern's option position for stickers, a reference to the stored content
+// for media (see storage.Ref), and the address for locations. Otherwise the
+// user is told the input can't be read and stays where they are.
+func (es *EventService) HandleInput(lineUserID string, in Input, replyToken string) {
+	user, err := model.FindOrCreateByLineUserID(lineUserID)
+	if err != nil {
+		log.Printf("Error finding user: %v", err)
+		return
+	}
+
+	received := in.MessageID
+	if rp := pendingReplyPattern(user, in.Type); rp != nil {
+		received = es.receivedValue(user, rp, in)
+	}
+	es.handle(user, received, in.Type, replyToken)
+}
+
+func (es *EventService) handle(user *model.User, receivedMessage, inputType, replyToken string) {
+	es.ensureRichMenu(user)
 
 	// ReplyPatternService にアクションレジストリを接続
 	rps := NewReplyPatternService(user, receivedMessage, replyToken, es.sendService)
 	rps.SetActionExecutor(es.actionRegistry)
+	rps.SetInputType(inputType)
 
 	// Chain of responsibility - same order as Rails
 	services := []ServiceHandler{
@@ -53,7 +116,9 @@ func (es *EventService) HandleMessage(lineUserID, receivedMessage, replyToken st
 		NewTopBackService(user, receivedMessage, replyToken, es.sendService),
 		NewBackService(user, receivedMessage, replyToken, es.sendService),
 		NewAdminLoginService(user, receivedMessage, replyToken, es.sendService),
+		NewBroadcastResendService(user, receivedMessage, replyToken, es.sendService),
 		rps,
+		NewUnsupportedInputService(user, inputType, replyToken, es.sendService),
 	}
 
 	for _, svc := range services {
@@ -66,6 +131,142 @@ func (es *EventService) HandleMessage(lineUserID, receivedMessage, replyToken st
 	NewTopMessageSendService(user, receivedMessage, replyToken, es.sendService).Execute()
 }
 
+// receivedValue converts a non-text input into the received message for the pattern's action.
+func (es *EventService) receivedValue(user *model.User, rp *model.ReplyPattern, in Input) string {
+	switch in.Type {
+	case model.InputTypeSticker:
+		// スタンプは選択肢を押したものとして扱う
+		if rp.Position != nil {
+			return strconv.Itoa(*rp.Position)
+		}
+		return strings.Join(in.Keywords, ",")
+	case model.InputTypeLocation:
+		if in.Address != "" {
+			return in.Address
+		}
+		return fmt.Sprintf("%f,%f", in.Latitude, in.Longitude)
+	case model.InputTypeImage, model.InputTypeVideo, model.InputTypeAudio, model.InputTypeFile:
+		url, err := es.contentService.SaveMessageContent(user, in.MessageID)
+		if err != nil {
+			log.Printf("Error saving %s %s: %v", in.Type, in.MessageID, err)
+			return in.MessageID
+		}
+		return url
+	}
+	return in.MessageID
+}
+
+// pendingReplyPattern returns the reply pattern that accepts the given input
+// type at the point the user is in the conversation.
+func pendingReplyPattern(user *model.User, inputType string) *model.ReplyPattern {
+	th, err := user.GetLatestTalkHistory()
+	if err != nil || th == nil {
+		return nil
+	}
+	return model.FindReplyPatternByMessageAndInputType(th.MessageID, inputType)
+}
+
+// HandlePostback handles a postback event from a quick-reply or template button.
+// Option postbacks carry the option position and go through the same
+// reply-pattern lookup as a typed number.
+func (es *EventService) HandlePostback(lineUserID, data, replyToken string) {
+	values, err := url.ParseQuery(data)
+	if err == nil && values.Has(ItemPostbackKey) {
+		es.handleListItemPostback(lineUserID, values, replyToken)
+		return
+	}
+	if id, err := strconv.ParseUint(values.Get(ContinuationPostbackKey), 10, 64); err == nil {
+		es.sendService.ReplyContinuation(lineUserID, uint(id), replyToken)
+		return
+	}
+	pos, ok := parseOptionPostback(data)
+	if !ok {
+		log.Printf("Unknown postback data: %s", data)
+		return
+	}
+	es.HandleMessage(lineUserID, strconv.Itoa(pos), replyToken)
+}
+
+// staleListText is sent when a list item button is tapped after the user has
+// moved on from the list.
+const staleListText = "この一覧は古くなっています。もう一度一覧を開いてください。"
+
+// handleListItemPostback handles a list item button (see ListItemPostbackData):
+// it picks the item as if its number were typed, then selects the option.
+// Only the option's reply is sent, since a reply token can be used once.
+// Buttons of a list whose items have since been added, deleted or reordered
+// are refused rather than acting on whatever record now has the number.
+func (es *EventService) handleListItemPostback(lineUserID string, values url.Values, replyToken string) {
+	listID, err1 := strconv.ParseUint(values.Get(ListPostbackKey), 10, 64)
+	item, err2 := strconv.Atoi(values.Get(ItemPostbackKey))
+	option, err3 := strconv.Atoi(values.Get(OptionPostbackKey))
+	recordID, err4 := strconv.ParseUint(values.Get(RecordPostbackKey), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		log.Printf("Invalid list item postback: %s", values.Encode())
+		return
+	}
+	user, err := model.FindOrCreateByLineUserID(lineUserID)
+	if err != nil {
+		log.Printf("Error finding user: %v", err)
+		return
+	}
+
+	if th, err := user.GetLatestTalkHistory(); err != nil || th == nil || th.MessageID != uint(listID) {
+		es.sendService.ReplyTo(lineUserID, staleListText, replyToken)
+		return
+	}
+	if id, ok := es.actionRegistry.ListRecordID(user, values.Get(KindPostbackKey), item); !ok || id != uint(recordID) {
+		es.sendService.ReplyTo(lineUserID, staleListText, replyToken)
+		return
+	}
+	// 番号の選択は返信せずに進める（返信は記録するだけで送らない）
+	es.silent().handle(user, strconv.Itoa(item), model.InputTypeText, "")
+
+	// 番号の選択で選択肢のあるメッセージに進めなかった場合は送らない
+	th, err := user.GetLatestTalkHistory()
+	if err != nil || th == nil || model.FindReplyPatternByMessageAndPosition(th.MessageID, option) == nil {
+		es.sendService.ReplyTo(lineUserID, staleListText, replyToken)
+		return
+	}
+	es.handle(user, strconv.Itoa(option), model.InputTypeText, replyToken)
+}
+
+// ensureRichMenu relinks the user's rich menu if their member type, plan or
+// shik status changed since it was linked.
+func (es *EventService) ensureRichMenu(user *model.User) {
+	if es.richMenus == nil {
+		return
+	}
+	if err := es.richMenus.EnsureLinked(user); err != nil {
+		log.Printf("Error linking rich menu of user %d: %v", user.ID, err)
+	}
+}
+
+// silent returns a copy of the service whose replies are recorded instead of
+// sent. Its actions get the recording SendService too, so nothing they send
+// (e.g. a test send) reaches LINE.
+func (es *EventService) silent() *EventService {
+	ss := NewSendServiceWith(NewRecordingMessenger())
+	return &EventService{
+		sendService:    ss,
+		contentService: es.contentService,
+		actionRegistry: action.NewRegistry(ss),
+	}
+}
+
+// parseOptionPostback extracts the option position from postback data such as "option=2".
+func parseOptionPostback(data string) (int, bool) {
+	values, err := url.ParseQuery(data)
+	if err != nil {
+		return 0, false
+	}
+	pos, err := strconv.Atoi(values.Get(OptionPostbackKey))
+	if err != nil {
+		return 0, false
+	}
+	return pos, true
+}
+
 // ServiceHandler interface for chain of responsibility pattern.
 type ServiceHandler interface {
 	Executed() bool
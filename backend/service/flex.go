@@ -0,0 +1,142 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/RyokouKanai/gomethod/view"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// LINE limits for Flex Messages.
+const (
+	maxCarouselBubbles = 12
+	maxReplyMessages   = 5
+	maxPushMessages    = 5
+	maxAltText         = 400
+	maxFlexButtonLabel = 40
+)
+
+// Postback data keys of list item buttons.
+const (
+	ListPostbackKey   = "list"
+	ItemPostbackKey   = "item"
+	KindPostbackKey   = "kind"
+	RecordPostbackKey = "record"
+)
+
+// flexListsEnabled reports whether lists are sent as Flex carousels.
+// Set FLEX_LISTS_ENABLED=true; otherwise lists are sent as plain text.
+func flexListsEnabled() bool {
+	return os.Getenv("FLEX_LISTS_ENABLED") == "true"
+}
+
+// listMessages renders a list as its header followed by Flex carousels.
+// Lists too long to fit in one reply are sent as plain text instead.
+func listMessages(l *view.List) []messaging_api.MessageInterface {
+	if !flexListsEnabled() || len(l.Items) == 0 {
+		return toLineMessages(l.Text())
+	}
+
+	var messages []messaging_api.MessageInterface
+	if l.Header != "" {
+		messages = toLineMessages(l.Header)
+	}
+	carousels := (len(l.Items) + maxCarouselBubbles - 1) / maxCarouselBubbles
+	if len(messages)+carousels > maxReplyMessages {
+		return toLineMessages(l.Text())
+	}
+
+	for i := 0; i < len(l.Items); i += maxCarouselBubbles {
+		end := i + maxCarouselBubbles
+		if end > len(l.Items) {
+			end = len(l.Items)
+		}
+		bubbles := make([]messaging_api.FlexBubble, 0, end-i)
+		for _, it := range l.Items[i:end] {
+			bubbles = append(bubbles, itemBubble(l, it))
+		}
+		messages = append(messages, &messaging_api.FlexMessage{
+			AltText:  truncateRunes(listAltText(l.Items[i:end]), maxAltText),
+			Contents: &messaging_api.FlexCarousel{Contents: bubbles},
+		})
+	}
+	return messages
+}
+
+// listAltText is shown where the carousel can't be, e.g. in notifications
+// and on clients without Flex support.
+func listAltText(items []view.Item) string {
+	text := ""
+	for i, it := range items {
+		if i > 0 {
+			text += "\n\n"
+		}
+		text += it.Text()
+	}
+	return text
+}
+
+// itemBubble renders one list item: thumbnail, number, date, content and
+// the item's buttons.
+func itemBubble(l *view.List, it view.Item) messaging_api.FlexBubble {
+	contents := []messaging_api.FlexComponentInterface{
+		&messaging_api.FlexText{Text: strconv.Itoa(it.Number), Weight: messaging_api.FlexTextWEIGHT_BOLD, Size: "lg"},
+	}
+	if it.Date != "" {
+		contents = append(contents, &messaging_api.FlexText{Text: it.Date, Size: "xs", Color: "#999999"})
+	}
+	content := it.Content
+	if content == "" {
+		content = "-"
+	}
+	contents = append(contents, &messaging_api.FlexText{Text: content, Wrap: true, MaxLines: 8, Margin: "md"})
+	for _, note := range it.Notes {
+		contents = append(contents, &messaging_api.FlexText{Text: note, Size: "xs", Color: "#999999", Margin: "sm"})
+	}
+
+	bubble := messaging_api.FlexBubble{
+		Size: messaging_api.FlexBubbleSIZE_KILO,
+		Body: &messaging_api.FlexBox{Layout: messaging_api.FlexBoxLAYOUT_VERTICAL, Contents: contents},
+	}
+	if it.ImageURL != "" {
+		bubble.Hero = &messaging_api.FlexImage{
+			Url:         it.ImageURL,
+			Size:        "full",
+			AspectRatio: "20:13",
+			AspectMode:  messaging_api.FlexImageASPECT_MODE_COVER,
+		}
+	}
+	if len(l.Buttons) > 0 {
+		buttons := make([]messaging_api.FlexComponentInterface, 0, len(l.Buttons))
+		for _, b := range l.Buttons {
+			buttons = append(buttons, &messaging_api.FlexButton{
+				Style:  messaging_api.FlexButtonSTYLE_LINK,
+				Height: messaging_api.FlexButtonHEIGHT_SM,
+				Action: &messaging_api.PostbackAction{
+					Label:       truncateRunes(b.Label, maxFlexButtonLabel),
+					Data:        ListItemPostbackData(l.MessageID, l.Kind, it.RecordID, it.Number, b.Option),
+					DisplayText: truncateRunes(fmt.Sprintf("%d: %s", it.Number, b.Label), maxPostbackDisplayText),
+				},
+			})
+		}
+		bubble.Footer = &messaging_api.FlexBox{Layout: messaging_api.FlexBoxLAYOUT_VERTICAL, Contents: buttons}
+	}
+	return bubble
+}
+
+// ListItemPostbackData returns the postback data that picks the item of the
+// list shown at the given message and then selects the option. The item's
+// record is included so the tap is refused once another record has taken
+// its number.
+func ListItemPostbackData(messageID uint, kind string, recordID uint, item, option int) string {
+	v := url.Values{}
+	v.Set(ListPostbackKey, strconv.FormatUint(uint64(messageID), 10))
+	v.Set(KindPostbackKey, kind)
+	v.Set(RecordPostbackKey, strconv.FormatUint(uint64(recordID), 10))
+	v.Set(ItemPostbackKey, strconv.Itoa(item))
+	v.Set(OptionPostbackKey, strconv.Itoa(option))
+	return v.Encode()
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"io"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+const (
+	retryKeyHeader  = "X-Line-Retry-Key"
+	requestIDHeader = "X-Line-Request-Id"
+	// acceptedRequestIDHeader is set on a 409 when a request with the same
+	// retry key was already accepted.
+	acceptedRequestIDHeader = "X-Line-Accepted-Request-Id"
+)
+
+// lineHTTPClient is shared by all LINE API clients so retries apply everywhere.
+var lineHTTPClient = &http.Client{
+	Timeout: 60 * time.Second,
+	Transport: &retryTransport{
+		base:          http.DefaultTransport,
+		maxAttempts:   getEnvInt("LINE_RETRY_MAX_ATTEMPTS", 4),
+		baseDelay:     500 * time.Millisecond,
+		maxDelay:      10 * time.Second,
+		maxRetryAfter: 30 * time.Second,
+	},
+}
+
+// lineAPIOptions configures a Messaging API client with the shared HTTP
+// client and, if set, the endpoint override (LINE_API_ENDPOINT).
+func lineAPIOptions(endpoint string) []messaging_api.MessagingApiAPIOption {
+	opts := []messaging_api.MessagingApiAPIOption{messaging_api.WithHTTPClient(lineHTTPClient)}
+	if endpoint != "" {
+		opts = append(opts, messaging_api.WithEndpoint(endpoint))
+	}
+	return opts
+}
+
+// lineBlobAPIOptions is lineAPIOptions for the content API (LINE_API_DATA_ENDPOINT).
+func lineBlobAPIOptions() []messaging_api.MessagingApiBlobAPIOption {
+	opts := []messaging_api.MessagingApiBlobAPIOption{messaging_api.WithBlobHTTPClient(lineHTTPClient)}
+	if endpoint := os.Getenv("LINE_API_DATA_ENDPOINT"); endpoint != "" {
+		opts = append(opts, messaging_api.WithBlobEndpoint(endpoint))
+	}
+	return opts
+}
+
+// retryTransport retries LINE API requests that hit rate limits (429) or
+// server errors (5xx) with exponential backoff, honouring Retry-After.
+//
+// A 429 means the request was not processed, so it is always retried.
+// Server and network errors may have happened after LINE accepted the
+// message, so those are only retried when the request is safe to repeat:
+// GETs, and sends carrying an X-Line-Retry-Key, which LINE deduplicates.
+type retryTransport struct {
+	base          http.RoundTripper
+	maxAttempts   int
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	maxRetryAfter time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	// SDK は空のリトライキーもヘッダーに設定するため取り除く
+	if req.Header.Get(retryKeyHeader) == "" {
+		req.Header.Del(retryKeyHeader)
+	}
+	idempotent := req.Method == http.MethodGet || req.Header.Get(retryKeyHeader) != ""
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.maxAttempts || !shouldRetry(resp, err, idempotent) {
+			return resp, err
+		}
+
+		delay, ok := t.delay(attempt, resp)
+		if !ok {
+			return resp, err
+		}
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Printf("LINE API %s %s failed (%s), retrying in %s (attempt %d/%d)",
+			req.Method, req.URL.Path, reason, delay, attempt, t.maxAttempts)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func shouldRetry(resp *http.Response, err error, idempotent bool) bool {
+	if err != nil {
+		return idempotent
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return resp.StatusCode >= 500 && idempotent
+}
+
+// delay returns how long to wait before the next attempt. It returns false
+// if the server asked to wait longer than we are willing to.
+func (t *retryTransport) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return d, d <= t.maxRetryAfter
+		}
+	}
+	d := t.baseDelay << uint(attempt-1)
+	if d > t.maxDelay {
+		d = t.maxDelay
+	}
+	// 複数インスタンスが同時にリトライしないよう揺らぎを入れる
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)+1)), true
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		d := time.Until(at)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func getEnvInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
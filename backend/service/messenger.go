@@ -0,0 +1,181 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// Messenger sends messages to LINE users. LineMessenger talks to the
+// Messaging API; RecordingMessenger keeps what was sent in memory so tests
+// can run without LINE credentials.
+//
+// Push, Multicast and Broadcast pass the retry key on to LINE, so repeating a
+// request with the same key delivers the message at most once.
+type Messenger interface {
+	Reply(replyToken string, messages []messaging_api.MessageInterface) error
+	Push(to string, messages []messaging_api.MessageInterface, retryKey string) delivery.Result
+	Multicast(to []string, messages []messaging_api.MessageInterface, retryKey string) delivery.Result
+	Broadcast(messages []messaging_api.MessageInterface, retryKey string) delivery.Result
+	// ShowLoading shows the loading animation in the user's chat for the
+	// given seconds (5 to 60, in steps of 5), or until a message arrives.
+	ShowLoading(chatID string, seconds int) error
+}
+
+// ErrInvalidReplyToken is returned by Reply when LINE rejects the reply
+// token because it expired or was already used.
+var ErrInvalidReplyToken = errors.New("invalid reply token")
+
+// QuotaReporter is implemented by messengers that can tell how much of the
+// monthly message quota is left. limited is false on unlimited plans.
+type QuotaReporter interface {
+	RemainingQuota() (remaining int64, limited bool, err error)
+}
+
+var (
+	defaultMessengerMu sync.Mutex
+	defaultMessenger   Messenger
+)
+
+// DefaultMessenger returns the messenger used by NewSendService: the one set
+// with SetDefaultMessenger, or a LineMessenger configured from the environment.
+//
+//	LINE_CHANNEL_TOKEN: channel access token
+//	LINE_API_ENDPOINT:  Messaging API base URL, e.g. a local stand-in (default LINE's)
+func DefaultMessenger() Messenger {
+	defaultMessengerMu.Lock()
+	defer defaultMessengerMu.Unlock()
+	if defaultMessenger != nil {
+		return defaultMessenger
+	}
+	m, err := NewLineMessenger(os.Getenv("LINE_CHANNEL_TOKEN"), os.Getenv("LINE_API_ENDPOINT"))
+	if err != nil {
+		log.Printf("Error creating LINE bot: %v", err)
+		return unavailableMessenger{}
+	}
+	return m
+}
+
+// SetDefaultMessenger makes NewSendService use m, e.g. a RecordingMessenger in
+// tests. Passing nil goes back to the LineMessenger from the environment.
+func SetDefaultMessenger(m Messenger) {
+	defaultMessengerMu.Lock()
+	defer defaultMessengerMu.Unlock()
+	defaultMessenger = m
+}
+
+// LineMessenger sends messages with the LINE Messaging API.
+type LineMessenger struct {
+	bot *messaging_api.MessagingApiAPI
+}
+
+// NewLineMessenger creates a LineMessenger. An empty endpoint uses LINE's.
+func NewLineMessenger(channelToken, endpoint string) (*LineMessenger, error) {
+	bot, err := messaging_api.NewMessagingApiAPI(channelToken, lineAPIOptions(endpoint)...)
+	if err != nil {
+		return nil, err
+	}
+	return &LineMessenger{bot: bot}, nil
+}
+
+func (m *LineMessenger) Reply(replyToken string, messages []messaging_api.MessageInterface) error {
+	res, _, err := m.bot.ReplyMessageWithHttpInfo(&messaging_api.ReplyMessageRequest{
+		ReplyToken: replyToken,
+		Messages:   messages,
+	})
+	// LINE は期限切れも使用済みも同じ 400 で返す
+	if err != nil && res != nil && res.StatusCode == http.StatusBadRequest && strings.Contains(err.Error(), "Invalid reply token") {
+		return fmt.Errorf("%w: %v", ErrInvalidReplyToken, err)
+	}
+	return err
+}
+
+func (m *LineMessenger) Push(to string, messages []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	res, _, err := m.bot.PushMessageWithHttpInfo(&messaging_api.PushMessageRequest{
+		To:       to,
+		Messages: messages,
+	}, retryKey)
+	return sendResult(delivery.Result{Kind: delivery.KindPush, To: to, RetryKey: retryKey}, res, err)
+}
+
+func (m *LineMessenger) Multicast(to []string, messages []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	res, _, err := m.bot.MulticastWithHttpInfo(&messaging_api.MulticastRequest{
+		To:       to,
+		Messages: messages,
+	}, retryKey)
+	return sendResult(delivery.Result{Kind: delivery.KindMulticast, RetryKey: retryKey}, res, err)
+}
+
+func (m *LineMessenger) Broadcast(messages []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	res, _, err := m.bot.BroadcastWithHttpInfo(&messaging_api.BroadcastRequest{
+		Messages: messages,
+	}, retryKey)
+	return sendResult(delivery.Result{Kind: delivery.KindBroadcast, RetryKey: retryKey}, res, err)
+}
+
+func (m *LineMessenger) ShowLoading(chatID string, seconds int) error {
+	_, err := m.bot.ShowLoadingAnimation(&messaging_api.ShowLoadingAnimationRequest{
+		ChatId:         chatID,
+		LoadingSeconds: int32(seconds),
+	})
+	return err
+}
+
+// RemainingQuota returns the messages left this month: the target limit
+// minus what was already sent.
+func (m *LineMessenger) RemainingQuota() (int64, bool, error) {
+	quota, err := m.bot.GetMessageQuota()
+	if err != nil {
+		return 0, false, err
+	}
+	if quota.Type != messaging_api.QuotaType_LIMITED {
+		return 0, false, nil
+	}
+	used, err := m.bot.GetMessageQuotaConsumption()
+	if err != nil {
+		return 0, false, err
+	}
+	return quota.Value - used.TotalUsage, true, nil
+}
+
+// sendResult fills in the result from the LINE API response.
+func sendResult(result delivery.Result, res *http.Response, err error) delivery.Result {
+	if res != nil {
+		result.StatusCode = res.StatusCode
+		result.RequestID = res.Header.Get(requestIDHeader)
+		// 同じリトライキーのリクエストが既に受け付けられている
+		if res.StatusCode == http.StatusConflict && res.Header.Get(acceptedRequestIDHeader) != "" {
+			result.RequestID = res.Header.Get(acceptedRequestIDHeader)
+			return result
+		}
+	}
+	result.Err = err
+	return result
+}
+
+// unavailableMessenger fails every send; it stands in when the LINE client
+// could not be created.
+type unavailableMessenger struct{}
+
+func (unavailableMessenger) Reply(string, []messaging_api.MessageInterface) error { return errNoBot }
+
+func (unavailableMessenger) Push(to string, _ []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	return delivery.Result{Kind: delivery.KindPush, To: to, RetryKey: retryKey, Err: errNoBot}
+}
+
+func (unavailableMessenger) Multicast(_ []string, _ []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	return delivery.Result{Kind: delivery.KindMulticast, RetryKey: retryKey, Err: errNoBot}
+}
+
+func (unavailableMessenger) ShowLoading(string, int) error { return errNoBot }
+
+func (unavailableMessenger) Broadcast(_ []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	return delivery.Result{Kind: delivery.KindBroadcast, RetryKey: retryKey, Err: errNoBot}
+}
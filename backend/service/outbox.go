@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+const (
+	// staleSendingAfter is how long a message may stay sending before it is
+	// assumed the instance stopped mid-send and the message is taken again.
+	staleSendingAfter = 10 * time.Minute
+	outboxBatchSize   = 50
+	// outboxMaxBackoff caps the wait between attempts of one message.
+	outboxMaxBackoff = 30 * time.Minute
+)
+
+// outboxFailureNotice is pushed to NotifyLineUserID when delivery finally fails.
+const outboxFailureNotice = "配信の一部が失敗しました（%d人）。\n「再送信」と送ると失敗した宛先に送り直します。"
+
+// OutboxDispatcher delivers queued outbox messages to LINE.
+type OutboxDispatcher struct {
+	ss          *SendService
+	interval    time.Duration
+	maxAttempts int
+	workers     int
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+var outboxDispatcher *OutboxDispatcher
+
+// StartOutboxDispatcher starts delivering outbox messages in the background.
+//
+//	OUTBOX_POLL_SECONDS:  how often the outbox is checked (default 2)
+//	OUTBOX_MAX_ATTEMPTS:  attempts before a message is given up (default 5)
+//	OUTBOX_WORKERS:       messages sent at once (default LINE_MULTICAST_CONCURRENCY or 4)
+func StartOutboxDispatcher() {
+	d := &OutboxDispatcher{
+		ss:          NewSendService(),
+		interval:    time.Duration(getEnvInt("OUTBOX_POLL_SECONDS", 2)) * time.Second,
+		maxAttempts: getEnvInt("OUTBOX_MAX_ATTEMPTS", 5),
+		workers:     getEnvInt("OUTBOX_WORKERS", getEnvInt("LINE_MULTICAST_CONCURRENCY", 4)),
+		done:        make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stop = cancel
+	outboxDispatcher = d
+	go d.run(ctx)
+}
+
+// ShutdownOutboxDispatcher stops taking new messages and waits for the sends
+// in progress. Messages still sending when ctx is done are taken again by
+// the next instance once they go stale.
+func ShutdownOutboxDispatcher(ctx context.Context) error {
+	d := outboxDispatcher
+	if d == nil {
+		return nil
+	}
+	d.stop()
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *OutboxDispatcher) run(ctx context.Context) {
+	defer close(d.done)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		// 取り出せる限り続けて送る
+		for ctx.Err() == nil && d.dispatch() == outboxBatchSize {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch sends one batch of due messages and returns how many it took.
+func (d *OutboxDispatcher) dispatch() int {
+	msgs, err := model.ClaimOutboxMessages(outboxBatchSize, time.Now().Add(-staleSendingAfter))
+	if err != nil {
+		log.Printf("Error claiming outbox messages: %v", err)
+	}
+
+	sem := make(chan struct{}, d.workers)
+	var wg sync.WaitGroup
+	for i := range msgs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m *model.OutboxMessage) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			d.deliver(m)
+		}(&msgs[i])
+	}
+	wg.Wait()
+	return len(msgs)
+}
+
+// deliver sends one message with its retry key and records the outcome.
+func (d *OutboxDispatcher) deliver(m *model.OutboxMessage) {
+	message, err := m.PlainMessage()
+	if err != nil {
+		log.Printf("Outbox message %d cannot be decrypted: %v", m.ID, err)
+		if err := m.MarkFailed(0, "", "cannot decrypt message"); err != nil {
+			log.Printf("Error updating outbox message %d: %v", m.ID, err)
+		}
+		return
+	}
+
+	var results []delivery.Result
+	switch m.Kind {
+	case delivery.KindBroadcast:
+		results = []delivery.Result{d.ss.broadcast(message, m.RetryKey)}
+	case delivery.KindMulticast:
+		results = d.ss.multicast(message, m.RecipientIDs(), m.RetryKey)
+	default:
+		ids := m.RecipientIDs()
+		if len(ids) == 0 {
+			results = []delivery.Result{{Kind: m.Kind, RetryKey: m.RetryKey, Err: fmt.Errorf("outbox message %d has no recipient", m.ID)}}
+			break
+		}
+		results = []delivery.Result{d.ss.unicast(ids[0], message, m.RetryKey)}
+	}
+	if len(results) == 0 {
+		results = []delivery.Result{{Kind: m.Kind, RetryKey: m.RetryKey}}
+	}
+
+	// 1リクエストなので結果はすべて同じ
+	r := results[0]
+	switch {
+	case r.OK():
+		if err = m.MarkSent(r.StatusCode, r.RequestID); err == nil {
+			d.countSent(m, results)
+		}
+	case m.Attempts < d.maxAttempts && retryable(r):
+		next := time.Now().Add(outboxBackoff(m.Attempts))
+		log.Printf("Outbox message %d failed (attempt %d), retrying at %s: %v", m.ID, m.Attempts, next.Format(time.RFC3339), r.Err)
+		err = m.MarkRetry(r.StatusCode, r.RequestID, r.Err.Error(), next)
+	default:
+		log.Printf("Outbox message %d failed after %d attempts: %v", m.ID, m.Attempts, r.Err)
+		if err = m.MarkFailed(r.StatusCode, r.RequestID, r.Err.Error()); err == nil {
+			d.giveUp(m, message, results)
+		}
+	}
+	if err != nil {
+		log.Printf("Error updating outbox message %d: %v", m.ID, err)
+	}
+}
+
+// countSent adds the recipients of a delivered message to its source's run.
+func (d *OutboxDispatcher) countSent(m *model.OutboxMessage, results []delivery.Result) {
+	count := len(results)
+	if m.Kind == delivery.KindBroadcast {
+		if n, err := model.CountFollowingUsers(); err == nil {
+			count = int(n)
+		}
+	}
+	if err := model.AddBatchRunSent(m.Source, count); err != nil {
+		log.Printf("Error recording sends of %s: %v", m.Source, err)
+	}
+}
+
+// giveUp records the recipients of a failed message as send failures of its
+// source, so they can be resent like any other failed send.
+func (d *OutboxDispatcher) giveUp(m *model.OutboxMessage, message string, results []delivery.Result) {
+	recordFailures(m.Source, message, results...)
+	if err := model.AddBatchRunFailures(m.Source, len(results)); err != nil {
+		log.Printf("Error recording failures of %s: %v", m.Source, err)
+	}
+	if m.NotifyLineUserID == "" {
+		return
+	}
+	count := len(results)
+	if m.Kind == delivery.KindBroadcast {
+		if n, err := model.CountFollowingUsers(); err == nil {
+			count = int(n)
+		}
+	}
+	d.ss.Unicast(m.NotifyLineUserID, fmt.Sprintf(outboxFailureNotice, count))
+}
+
+// retryable reports whether another attempt may succeed. Other 4xx errors
+// (bad request, invalid user ID) fail the same way every time.
+func retryable(r delivery.Result) bool {
+	if r.StatusCode == 0 || r.StatusCode == 429 || r.StatusCode >= 500 {
+		return true
+	}
+	return false
+}
+
+// outboxBackoff returns the wait before the next attempt: 30s, 1m, 2m, ...
+func outboxBackoff(attempts int) time.Duration {
+	wait := 30 * time.Second
+	for i := 1; i < attempts && wait < outboxMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > outboxMaxBackoff {
+		wait = outboxMaxBackoff
+	}
+	return wait
+}
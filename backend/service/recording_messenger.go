@@ -0,0 +1,135 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// Kinds of recorded requests besides the delivery kinds.
+const (
+	KindReply   = "reply"
+	KindLoading = "loading"
+)
+
+// SentMessage is a request recorded by RecordingMessenger.
+type SentMessage struct {
+	Kind       string
+	ReplyToken string
+	To         []string
+	RetryKey   string
+	Messages   []messaging_api.MessageInterface
+	// LoadingSeconds is how long a loading animation was asked for.
+	LoadingSeconds int
+}
+
+// Texts returns the text of each text message of the request.
+func (s SentMessage) Texts() []string {
+	var texts []string
+	for _, m := range s.Messages {
+		if t, ok := m.(*messaging_api.TextMessage); ok {
+			texts = append(texts, t.Text)
+		}
+	}
+	return texts
+}
+
+// RecordingMessenger is an in-memory Messenger for tests. It records every
+// request instead of sending it and, like LINE, accepts a retry key only
+// once: a repeated key is answered as already accepted and not recorded again.
+type RecordingMessenger struct {
+	// Fail, when set, is asked about each request; a non-nil error fails it
+	// with status 500 as if LINE had returned a server error. Failing a reply
+	// with ErrInvalidReplyToken makes it look expired.
+	Fail func(SentMessage) error
+
+	mu       sync.Mutex
+	sent     []SentMessage
+	accepted map[string]string // retry key → request ID
+}
+
+// NewRecordingMessenger creates an empty RecordingMessenger.
+func NewRecordingMessenger() *RecordingMessenger {
+	return &RecordingMessenger{accepted: map[string]string{}}
+}
+
+// Sent returns the recorded requests in the order they were made.
+func (m *RecordingMessenger) Sent() []SentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentMessage(nil), m.sent...)
+}
+
+// Reset forgets the recorded requests and accepted retry keys.
+func (m *RecordingMessenger) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+	m.accepted = map[string]string{}
+}
+
+func (m *RecordingMessenger) Reply(replyToken string, messages []messaging_api.MessageInterface) error {
+	_, err := m.record(SentMessage{Kind: KindReply, ReplyToken: replyToken, Messages: messages})
+	return err
+}
+
+func (m *RecordingMessenger) Push(to string, messages []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	return m.send(delivery.Result{Kind: delivery.KindPush, To: to, RetryKey: retryKey},
+		SentMessage{Kind: delivery.KindPush, To: []string{to}, RetryKey: retryKey, Messages: messages})
+}
+
+func (m *RecordingMessenger) Multicast(to []string, messages []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	return m.send(delivery.Result{Kind: delivery.KindMulticast, RetryKey: retryKey},
+		SentMessage{Kind: delivery.KindMulticast, To: to, RetryKey: retryKey, Messages: messages})
+}
+
+func (m *RecordingMessenger) Broadcast(messages []messaging_api.MessageInterface, retryKey string) delivery.Result {
+	return m.send(delivery.Result{Kind: delivery.KindBroadcast, RetryKey: retryKey},
+		SentMessage{Kind: delivery.KindBroadcast, RetryKey: retryKey, Messages: messages})
+}
+
+func (m *RecordingMessenger) ShowLoading(chatID string, seconds int) error {
+	_, err := m.record(SentMessage{Kind: KindLoading, To: []string{chatID}, LoadingSeconds: seconds})
+	return err
+}
+
+func (m *RecordingMessenger) send(result delivery.Result, req SentMessage) delivery.Result {
+	m.mu.Lock()
+	if id, ok := m.accepted[req.RetryKey]; ok && req.RetryKey != "" {
+		m.mu.Unlock()
+		result.StatusCode = http.StatusConflict
+		result.RequestID = id
+		return result
+	}
+	m.mu.Unlock()
+
+	id, err := m.record(req)
+	if err != nil {
+		result.StatusCode = http.StatusInternalServerError
+		result.Err = err
+		return result
+	}
+	result.StatusCode = http.StatusOK
+	result.RequestID = id
+	return result
+}
+
+// record asks Fail about the request and records it if it succeeds.
+func (m *RecordingMessenger) record(req SentMessage) (string, error) {
+	if m.Fail != nil {
+		if err := m.Fail(req); err != nil {
+			return "", err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, req)
+	id := fmt.Sprintf("recorded-%d", len(m.sent))
+	if req.RetryKey != "" {
+		m.accepted[req.RetryKey] = id
+	}
+	return id, nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// quotaCheckInterval is how long the remaining message quota is trusted
+// before LINE is asked again.
+const quotaCheckInterval = 10 * time.Minute
+
+// replyFallbackEnabled reports whether a reply whose token LINE rejected is
+// pushed instead. Set REPLY_FALLBACK=off to drop such replies.
+func replyFallbackEnabled() bool {
+	return os.Getenv("REPLY_FALLBACK") != "off"
+}
+
+// recordReplyFallback stores a fallback in the ledger; tests replace it.
+var recordReplyFallback = model.CreateReplyFallback
+
+// reply sends messages with the reply token. If LINE rejects the token,
+// typically because handling took too long or the event was redelivered,
+// they are pushed to the user instead, unless REPLY_FALLBACK is off or the
+// push would eat into the quota reserve. It reports whether the messages
+// were delivered either way.
+func (s *SendService) reply(lineUserID string, messages []messaging_api.MessageInterface, replyToken string) bool {
+	err := s.messenger.Reply(replyToken, messages)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, ErrInvalidReplyToken) {
+		log.Printf("Error replying message: %v", err)
+		return false
+	}
+
+	f := &model.ReplyFallback{LineUserID: lineUserID, MessageCount: len(messages), ReplyError: err.Error()}
+	switch {
+	case lineUserID == "":
+		f.Outcome = model.ReplyFallbackNoUser
+	case !replyFallbackEnabled():
+		f.Outcome = model.ReplyFallbackDisabled
+	case !replyQuota.allows(s.messenger, len(messages)):
+		f.Outcome = model.ReplyFallbackQuota
+	default:
+		r := s.messenger.Push(lineUserID, messages, delivery.NewRetryKey())
+		f.StatusCode = r.StatusCode
+		f.RequestID = r.RequestID
+		if r.Err != nil {
+			f.Outcome = model.ReplyFallbackPushFailed
+			f.Error = r.Err.Error()
+		} else {
+			f.Outcome = model.ReplyFallbackPushed
+		}
+	}
+	log.Printf("Reply token rejected for %q, fallback %s: %v", lineUserID, f.Outcome, err)
+	if err := recordReplyFallback(f); err != nil {
+		log.Printf("Error recording reply fallback: %v", err)
+	}
+	return f.Outcome == model.ReplyFallbackPushed
+}
+
+// replyQuota keeps fallback pushes from using up the monthly quota that
+// broadcasts and scheduled sends rely on.
+var replyQuota quotaGuard
+
+type quotaGuard struct {
+	mu        sync.Mutex
+	remaining int64
+	limited   bool
+	checkedAt time.Time
+}
+
+// allows reports whether n more messages leave at least
+// REPLY_FALLBACK_QUOTA_RESERVE (default 1000) of the quota. Messengers that
+// cannot report a quota are always allowed. If LINE cannot be asked, the
+// push is allowed rather than losing the reply.
+func (g *quotaGuard) allows(m Messenger, n int) bool {
+	qr, ok := m.(QuotaReporter)
+	if !ok {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.checkedAt) > quotaCheckInterval {
+		remaining, limited, err := qr.RemainingQuota()
+		if err != nil {
+			log.Printf("Error checking message quota: %v", err)
+			return true
+		}
+		g.remaining, g.limited, g.checkedAt = remaining, limited, time.Now()
+	}
+	if !g.limited {
+		return true
+	}
+	if g.remaining-int64(n) < int64(getEnvInt("REPLY_FALLBACK_QUOTA_RESERVE", 1000)) {
+		return false
+	}
+	// 次の確認までの分も見込んで減らしておく
+	g.remaining -= int64(n)
+	return true
+}
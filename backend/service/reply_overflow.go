@@ -0,0 +1,135 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// What to do with the messages of a reply beyond LINE's five.
+const (
+	// ReplyOverflowPush pushes them right after the reply, five at a time, in order.
+	ReplyOverflowPush = "push"
+	// ReplyOverflowContinue keeps them until the user taps "続きを読む".
+	// Pushes count against the monthly message quota; this does not.
+	ReplyOverflowContinue = "continue"
+)
+
+// ContinuationPostbackKey is the postback data key of the "続きを読む" button.
+const ContinuationPostbackKey = "continuation"
+
+const (
+	continueReadingLabel = "続きを読む"
+	continueReadingText  = "続きがあります。"
+	expiredContinuation  = "続きの表示期限が切れました。もう一度メニューから開いてください。"
+)
+
+// replyOverflowPolicy returns LINE_REPLY_OVERFLOW: "push" (default) or "continue".
+func replyOverflowPolicy() string {
+	if os.Getenv("LINE_REPLY_OVERFLOW") == ReplyOverflowContinue {
+		return ReplyOverflowContinue
+	}
+	return ReplyOverflowPush
+}
+
+// replyMessages replies with at most five messages, LINE's limit per reply
+// token, and sends the rest to the user as replyOverflowPolicy says. Without
+// a user to send to, the rest is dropped.
+func (s *SendService) replyMessages(lineUserID string, messages []messaging_api.MessageInterface, replyToken string) {
+	if len(messages) > maxReplyMessages && lineUserID == "" {
+		log.Printf("Dropping %d messages over the reply limit", len(messages)-maxReplyMessages)
+		messages = messages[:maxReplyMessages]
+	}
+	if len(messages) <= maxReplyMessages {
+		s.reply(lineUserID, messages, replyToken)
+		return
+	}
+
+	if replyOverflowPolicy() == ReplyOverflowContinue {
+		more, err := s.saveContinuation(lineUserID, messages[maxReplyMessages-1:])
+		if err == nil {
+			s.reply(lineUserID, append(messages[:maxReplyMessages-1:maxReplyMessages-1], more), replyToken)
+			return
+		}
+		log.Printf("Error saving reply continuation, pushing instead: %v", err)
+	}
+
+	if !s.reply(lineUserID, messages[:maxReplyMessages], replyToken) {
+		return
+	}
+	// 順番が入れ替わらないよう1つずつ送る
+	for i := maxReplyMessages; i < len(messages); i += maxReplyMessages {
+		end := min(i+maxReplyMessages, len(messages))
+		if r := s.messenger.Push(lineUserID, messages[i:end], delivery.NewRetryKey()); r.Err != nil {
+			log.Printf("Error pushing rest of reply to %s: %v", lineUserID, r.Err)
+			return
+		}
+	}
+}
+
+// saveContinuation keeps the rest of a reply and returns the message whose
+// button sends it.
+func (s *SendService) saveContinuation(lineUserID string, rest []messaging_api.MessageInterface) (messaging_api.MessageInterface, error) {
+	data, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	c, err := model.ReplaceReplyContinuation(lineUserID, string(data))
+	if err != nil {
+		return nil, err
+	}
+	return &messaging_api.TextMessage{
+		Text: continueReadingText,
+		QuickReply: &messaging_api.QuickReply{Items: []messaging_api.QuickReplyItem{{
+			Action: &messaging_api.PostbackAction{
+				Label:       continueReadingLabel,
+				Data:        ContinuationPostbackData(c.ID),
+				DisplayText: continueReadingLabel,
+			},
+		}}},
+	}, nil
+}
+
+// ReplyContinuation replies with the rest of an earlier reply to the user.
+func (s *SendService) ReplyContinuation(lineUserID string, id uint, replyToken string) {
+	c, err := model.TakeReplyContinuation(id, lineUserID, time.Now().Add(-model.ReplyContinuationTTL))
+	if err != nil {
+		log.Printf("Error loading reply continuation %d: %v", id, err)
+		return
+	}
+	if c == nil {
+		s.ReplyTo(lineUserID, expiredContinuation, replyToken)
+		return
+	}
+
+	var raw []json.RawMessage
+	data, err := c.PlainMessages()
+	if err == nil {
+		err = json.Unmarshal([]byte(data), &raw)
+	}
+	if err != nil {
+		log.Printf("Error decoding reply continuation %d: %v", id, err)
+		return
+	}
+	messages := make([]messaging_api.MessageInterface, 0, len(raw))
+	for _, r := range raw {
+		m, err := messaging_api.UnmarshalMessage(r)
+		if err != nil {
+			log.Printf("Error decoding reply continuation %d: %v", id, err)
+			return
+		}
+		messages = append(messages, m)
+	}
+	s.replyMessages(lineUserID, messages, replyToken)
+}
+
+// ContinuationPostbackData returns the postback data of the "続きを読む" button.
+func ContinuationPostbackData(id uint) string {
+	return ContinuationPostbackKey + "=" + strconv.FormatUint(uint64(id), 10)
+}
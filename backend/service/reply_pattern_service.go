@@ -3,6 +3,7 @@ package service
 import (
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/RyokouKanai/gomethod/model"
 )
@@ -11,6 +12,7 @@ import (
 type ReplyPatternService struct {
 	BaseService
 	actionExecutor ActionExecutor
+	inputType      string
 }
 
 // ActionExecutor is an interface for executing reply pattern actions.
@@ -18,9 +20,22 @@ type ActionExecutor interface {
 	Execute(method string, user *model.User, receivedMessage string, replyToken string, nextMessage *model.Message) interface{}
 }
 
+// ActionDurationEstimator is implemented by action executors that know
+// which actions are slow.
+type ActionDurationEstimator interface {
+	ExpectedDuration(method string) time.Duration
+}
+
+// loadingThreshold returns LOADING_ANIMATION_THRESHOLD_MS (default 1000):
+// actions expected to take longer show the loading animation.
+func loadingThreshold() time.Duration {
+	return time.Duration(getEnvInt("LOADING_ANIMATION_THRESHOLD_MS", 1000)) * time.Millisecond
+}
+
 func NewReplyPatternService(user *model.User, msg, token string, ss *SendService) *ReplyPatternService {
 	return &ReplyPatternService{
 		BaseService: newBaseService(user, msg, token, ss),
+		inputType:   model.InputTypeText,
 	}
 }
 
@@ -29,6 +44,11 @@ func (s *ReplyPatternService) SetActionExecutor(ae ActionExecutor) {
 	s.actionExecutor = ae
 }
 
+// SetInputType sets the type of the received message (text by default).
+func (s *ReplyPatternService) SetInputType(inputType string) {
+	s.inputType = inputType
+}
+
 func (s *ReplyPatternService) Executed() bool {
 	return s.enablePatternReply() && s.execute()
 }
@@ -51,7 +71,7 @@ func (s *ReplyPatternService) execute() bool {
 	// Execute the method, get reply content
 	content := s.nextMessageContents(rp, nextMsg)
 
-	s.sendService.Reply(content, s.ReplyToken)
+	s.reply(content, nextMsg)
 	th, err := s.createTalkHistory(nextMsg)
 	if err == nil && th != nil {
 		rpID := int(rp.ID)
@@ -73,6 +93,7 @@ func (s *ReplyPatternService) nextMessageContents(rp *model.ReplyPattern, nextMs
 			}
 		}()
 
+		s.showLoadingFor(rp.ExecutionMethod)
 		result := s.actionExecutor.Execute(rp.ExecutionMethod, s.User, s.ReceivedMessage, s.ReplyToken, nextMsg)
 		if result != nil {
 			return result
@@ -89,6 +110,9 @@ func (s *ReplyPatternService) replyPattern() *model.ReplyPattern {
 		return nil
 	}
 
+	if s.inputType != model.InputTypeText {
+		return model.FindReplyPatternByMessageAndInputType(lastMsg.ID, s.inputType)
+	}
 	if s.receivedOption(lastMsg) {
 		pos, _ := strconv.Atoi(s.ReceivedMessage)
 		return model.FindReplyPatternByMessageAndPosition(lastMsg.ID, pos)
@@ -115,3 +139,15 @@ func (s *ReplyPatternService) receivedOption(lastMsg *model.Message) bool {
 	n, err := strconv.Atoi(s.ReceivedMessage)
 	return err == nil && n != 0
 }
+
+// showLoadingFor starts the loading animation if the action is expected to
+// take longer than loadingThreshold, so the user sees the bot is working.
+func (s *ReplyPatternService) showLoadingFor(method string) {
+	est, ok := s.actionExecutor.(ActionDurationEstimator)
+	if !ok {
+		return
+	}
+	if d := est.ExpectedDuration(method); d > loadingThreshold() {
+		s.sendService.ShowLoading(s.User.LineUserID, d)
+	}
+}
@@ -0,0 +1,386 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+const (
+	// richMenuCacheTTL is how long the menus used for linking on events are cached.
+	richMenuCacheTTL = 5 * time.Minute
+	// richMenuLinkBatch is LINE's limit of user IDs per bulk link request.
+	richMenuLinkBatch = 500
+)
+
+// RichMenuConfig is one rich menu in config/rich_menus.json.
+type RichMenuConfig struct {
+	Name        string   `json:"name"`
+	Position    int      `json:"position"`
+	MemberTypes []string `json:"member_types"`
+	PlanIDs     []int64  `json:"plan_ids"`
+	IsShik      *bool    `json:"is_shik"`
+	Default     bool     `json:"default"`
+	// Image is the menu image, relative to the config file.
+	Image string `json:"image"`
+	// Menu is the LINE rich menu object: size, selected, chatBarText and areas.
+	Menu json.RawMessage `json:"menu"`
+}
+
+// LoadRichMenuConfig reads and validates the rich menu definitions.
+func LoadRichMenuConfig(path string) ([]RichMenuConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []RichMenuConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	defaults := 0
+	for i := range configs {
+		c := &configs[i]
+		if c.Name == "" || names[c.Name] {
+			return nil, fmt.Errorf("rich menu %d: missing or duplicate name %q", i+1, c.Name)
+		}
+		names[c.Name] = true
+		if c.Default {
+			defaults++
+		}
+		if _, err := c.request(); err != nil {
+			return nil, fmt.Errorf("rich menu %s: %w", c.Name, err)
+		}
+		c.Image = filepath.Join(filepath.Dir(path), c.Image)
+		if _, err := os.Stat(c.Image); err != nil {
+			return nil, fmt.Errorf("rich menu %s: image: %w", c.Name, err)
+		}
+	}
+	if defaults > 1 {
+		return nil, fmt.Errorf("only one rich menu can be the default, got %d", defaults)
+	}
+	return configs, nil
+}
+
+// request decodes the menu into the Messaging API request.
+func (c *RichMenuConfig) request() (*messaging_api.RichMenuRequest, error) {
+	var req messaging_api.RichMenuRequest
+	if err := json.Unmarshal(c.Menu, &req); err != nil {
+		return nil, err
+	}
+	if req.Size == nil || len(req.Areas) == 0 {
+		return nil, fmt.Errorf("menu needs a size and at least one area")
+	}
+	req.Name = c.Name
+	return &req, nil
+}
+
+// checksum covers what LINE stores for the menu: the definition and the image.
+func (c *RichMenuConfig) checksum() (string, error) {
+	image, err := os.ReadFile(c.Image)
+	if err != nil {
+		return "", err
+	}
+	var menu bytes.Buffer
+	if err := json.Compact(&menu, c.Menu); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(menu.Bytes())
+	h.Write(image)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RichMenuSyncResult summarises a sync.
+type RichMenuSyncResult struct {
+	Uploaded  []string `json:"uploaded"`
+	Unchanged []string `json:"unchanged"`
+	Removed   []string `json:"removed"`
+	Relinked  int      `json:"relinked"`
+}
+
+// RichMenuService uploads rich menus and links users to them.
+type RichMenuService struct {
+	bot  *messaging_api.MessagingApiAPI
+	blob *messaging_api.MessagingApiBlobAPI
+}
+
+// NewRichMenuService creates a RichMenuService from the environment, like DefaultMessenger.
+func NewRichMenuService() (*RichMenuService, error) {
+	token := os.Getenv("LINE_CHANNEL_TOKEN")
+	bot, err := messaging_api.NewMessagingApiAPI(token, lineAPIOptions(os.Getenv("LINE_API_ENDPOINT"))...)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := messaging_api.NewMessagingApiBlobAPI(token, lineBlobAPIOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return &RichMenuService{bot: bot, blob: blob}, nil
+}
+
+// newRichMenuServiceOrNil returns nil when the LINE client cannot be
+// created, which leaves rich menus unlinked rather than failing events.
+func newRichMenuServiceOrNil() *RichMenuService {
+	s, err := NewRichMenuService()
+	if err != nil {
+		log.Printf("Error creating rich menu service: %v", err)
+		return nil
+	}
+	return s
+}
+
+// Sync makes LINE match the definitions: menus whose definition or image
+// changed are uploaded as new rich menus, users are relinked, and the menus
+// they replaced are deleted. With dryRun it only reports what it would do.
+func (s *RichMenuService) Sync(ctx context.Context, configs []RichMenuConfig, dryRun bool) (*RichMenuSyncResult, error) {
+	existing, err := model.GetRichMenus()
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*model.RichMenu{}
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+	}
+
+	result := &RichMenuSyncResult{}
+	var replaced []string
+	var defaultID string
+	for i := range configs {
+		c := &configs[i]
+		sum, err := c.checksum()
+		if err != nil {
+			return nil, fmt.Errorf("rich menu %s: %w", c.Name, err)
+		}
+		m := byName[c.Name]
+		delete(byName, c.Name)
+		if m == nil {
+			m = &model.RichMenu{Name: c.Name}
+		}
+		m.Position = c.Position
+		m.MemberTypes = strings.Join(c.MemberTypes, ",")
+		m.PlanIDs = joinInts(c.PlanIDs)
+		m.IsShik = c.IsShik
+		m.Default = c.Default
+		m.Definition = string(c.Menu)
+		m.ImagePath = c.Image
+
+		if m.Checksum == sum && m.LineRichMenuID != "" {
+			result.Unchanged = append(result.Unchanged, c.Name)
+		} else {
+			result.Uploaded = append(result.Uploaded, c.Name)
+			if dryRun {
+				continue
+			}
+			id, err := s.upload(c)
+			if err != nil {
+				return result, fmt.Errorf("uploading rich menu %s: %w", c.Name, err)
+			}
+			if m.LineRichMenuID != "" {
+				replaced = append(replaced, m.LineRichMenuID)
+			}
+			now := time.Now()
+			m.LineRichMenuID = id
+			m.Checksum = sum
+			m.Version++
+			m.SyncedAt = &now
+			log.Printf("Uploaded rich menu %s v%d as %s", m.Name, m.Version, id)
+		}
+		if m.Default {
+			defaultID = m.LineRichMenuID
+		}
+		if !dryRun {
+			if err := model.SaveRichMenu(m); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	// 定義から消えたメニュー
+	for _, m := range byName {
+		result.Removed = append(result.Removed, m.Name)
+		if dryRun {
+			continue
+		}
+		if m.LineRichMenuID != "" {
+			replaced = append(replaced, m.LineRichMenuID)
+		}
+		if err := model.DeleteRichMenu(m); err != nil {
+			return result, err
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	if defaultID != "" {
+		_, err = s.bot.SetDefaultRichMenu(defaultID)
+	} else {
+		_, err = s.bot.CancelDefaultRichMenu()
+	}
+	if err != nil {
+		return result, fmt.Errorf("setting default rich menu: %w", err)
+	}
+	invalidateRichMenuCache()
+
+	if result.Relinked, err = s.LinkAll(ctx); err != nil {
+		return result, err
+	}
+	// 古いメニューはユーザーを付け替えてから消す
+	for _, id := range replaced {
+		if _, err := s.bot.DeleteRichMenu(id); err != nil {
+			log.Printf("Error deleting replaced rich menu %s: %v", id, err)
+		}
+	}
+	return result, nil
+}
+
+// upload creates the rich menu on LINE and sets its image.
+func (s *RichMenuService) upload(c *RichMenuConfig) (string, error) {
+	req, err := c.request()
+	if err != nil {
+		return "", err
+	}
+	res, err := s.bot.CreateRichMenu(req)
+	if err != nil {
+		return "", err
+	}
+	image, err := os.Open(c.Image)
+	if err != nil {
+		return "", err
+	}
+	defer image.Close()
+	if _, err := s.blob.SetRichMenuImage(res.RichMenuId, mime.TypeByExtension(filepath.Ext(c.Image)), image); err != nil {
+		s.bot.DeleteRichMenu(res.RichMenuId)
+		return "", fmt.Errorf("setting image: %w", err)
+	}
+	return res.RichMenuId, nil
+}
+
+// EnsureLinked links the user to the rich menu their member type, plan and
+// shik status call for, if they are not linked to it already. It is cheap
+// when nothing changed, so it runs on every event.
+func (s *RichMenuService) EnsureLinked(u *model.User) error {
+	menus := cachedRichMenus()
+	if len(menus) == 0 {
+		return nil
+	}
+	want := model.RichMenuFor(menus, u)
+	if want == u.RichMenuID {
+		return nil
+	}
+	var err error
+	if want == "" {
+		_, err = s.bot.UnlinkRichMenuIdFromUser(u.LineUserID)
+	} else {
+		_, err = s.bot.LinkRichMenuIdToUser(u.LineUserID, want)
+	}
+	if err != nil {
+		return err
+	}
+	return u.UpdateRichMenuID(want)
+}
+
+// LinkAll relinks every following user whose rich menu no longer matches
+// them, e.g. after their plan changed outside the bot or a menu was
+// replaced. It returns how many users were relinked.
+func (s *RichMenuService) LinkAll(ctx context.Context) (int, error) {
+	menus, err := model.GetRichMenus()
+	if err != nil {
+		return 0, err
+	}
+	relinked := 0
+	var afterID uint
+	for {
+		if err := ctx.Err(); err != nil {
+			return relinked, err
+		}
+		users, err := model.GetUsersForRichMenuLinks(afterID, richMenuLinkBatch)
+		if err != nil {
+			return relinked, err
+		}
+		if len(users) == 0 {
+			return relinked, nil
+		}
+		afterID = users[len(users)-1].ID
+
+		// 付け替え先ごとにまとめて一括リンクする
+		byMenu := map[string][]*model.User{}
+		for i := range users {
+			if want := model.RichMenuFor(menus, &users[i]); want != users[i].RichMenuID {
+				byMenu[want] = append(byMenu[want], &users[i])
+			}
+		}
+		for want, us := range byMenu {
+			ids := make([]string, len(us))
+			for i, u := range us {
+				ids[i] = u.LineUserID
+			}
+			if want == "" {
+				_, err = s.bot.UnlinkRichMenuIdFromUsers(&messaging_api.RichMenuBulkUnlinkRequest{UserIds: ids})
+			} else {
+				_, err = s.bot.LinkRichMenuIdToUsers(&messaging_api.RichMenuBulkLinkRequest{RichMenuId: want, UserIds: ids})
+			}
+			if err != nil {
+				return relinked, fmt.Errorf("linking %d users to rich menu %q: %w", len(ids), want, err)
+			}
+			for _, u := range us {
+				if err := u.UpdateRichMenuID(want); err != nil {
+					log.Printf("Error recording rich menu of user %d: %v", u.ID, err)
+				}
+			}
+			relinked += len(us)
+		}
+	}
+}
+
+var richMenuCache struct {
+	sync.Mutex
+	menus    []model.RichMenu
+	loadedAt time.Time
+}
+
+// cachedRichMenus returns the rich menus, reloading them every richMenuCacheTTL.
+func cachedRichMenus() []model.RichMenu {
+	richMenuCache.Lock()
+	defer richMenuCache.Unlock()
+	if time.Since(richMenuCache.loadedAt) < richMenuCacheTTL {
+		return richMenuCache.menus
+	}
+	menus, err := model.GetRichMenus()
+	if err != nil {
+		log.Printf("Error loading rich menus: %v", err)
+		return richMenuCache.menus
+	}
+	richMenuCache.menus = menus
+	richMenuCache.loadedAt = time.Now()
+	return menus
+}
+
+func invalidateRichMenuCache() {
+	richMenuCache.Lock()
+	defer richMenuCache.Unlock()
+	richMenuCache.loadedAt = time.Time{}
+}
+
+func joinInts(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprint(id)
+	}
+	return strings.Join(parts, ",")
+}
@@ -1,162 +1,366 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"os"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/RyokouKanai/gomethod/model"
+	"github.com/RyokouKanai/gomethod/view"
 	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
 )
 
-// SendService handles sending messages via LINE Bot API.
+// maxMulticastRecipients is LINE's limit of user IDs per multicast request.
+const maxMulticastRecipients = 500
+
+// LINE limits for the loading animation.
+const (
+	minLoadingSeconds  = 5
+	maxLoadingSeconds  = 60
+	loadingSecondsStep = 5
+)
+
+// LINE limits for quick-reply buttons.
+const (
+	maxQuickReplyItems     = 13
+	maxQuickReplyLabel     = 20
+	maxPostbackDisplayText = 300
+)
+
+// errNoBot is returned when the LINE client could not be created.
+var errNoBot = errors.New("LINE bot client is not available")
+
+// OptionPostbackKey is the postback data key carrying an option position.
+const OptionPostbackKey = "option"
+
+// SendService renders messages and sends them through a Messenger.
 type SendService struct {
-	bot *messaging_api.MessagingApiAPI
+	messenger Messenger
 }
 
-// NewSendService creates a new SendService.
+// NewSendService creates a new SendService using DefaultMessenger.
 func NewSendService() *SendService {
-	bot, err := messaging_api.NewMessagingApiAPI(os.Getenv("LINE_CHANNEL_TOKEN"))
-	if err != nil {
-		log.Printf("Error creating LINE bot: %v", err)
-		return &SendService{}
-	}
-	return &SendService{bot: bot}
+	return NewSendServiceWith(DefaultMessenger())
+}
+
+// NewSendServiceWith creates a SendService that sends through m.
+func NewSendServiceWith(m Messenger) *SendService {
+	return &SendService{messenger: m}
 }
 
 // Reply sends a reply message to the given reply token.
 func (s *SendService) Reply(messages interface{}, replyToken string) {
-	if s.bot == nil {
-		return
-	}
+	s.ReplyWithOptions(messages, nil, replyToken)
+}
 
-	var lineMessages []messaging_api.MessageInterface
+// ReplyTo is Reply for a reply to the given user, so it can be pushed to
+// them if the reply token is no longer valid.
+func (s *SendService) ReplyTo(lineUserID string, messages interface{}, replyToken string) {
+	s.ReplyWithOptionsTo(lineUserID, messages, nil, replyToken)
+}
 
-	switch v := messages.(type) {
-	case string:
-		chunks := splitMessage(v, 4500)
-		for _, chunk := range chunks {
-			lineMessages = append(lineMessages, &messaging_api.TextMessage{Text: chunk})
-		}
-	case []string:
-		for _, msg := range v {
-			lineMessages = append(lineMessages, &messaging_api.TextMessage{Text: msg})
-		}
-	}
+// ReplyWithOptions sends a reply message and attaches the given options as
+// quick-reply buttons on the last bubble. Each button posts back the
+// option position, so tapping it behaves like typing the number.
+func (s *SendService) ReplyWithOptions(messages interface{}, options []model.Option, replyToken string) {
+	s.ReplyWithOptionsTo("", messages, options, replyToken)
+}
 
+// ReplyWithOptionsTo is ReplyWithOptions for a reply to the given user.
+// Messages beyond LINE's five per reply are sent to them afterwards, and
+// the reply is pushed if its token was rejected; see replyMessages and reply.
+func (s *SendService) ReplyWithOptionsTo(lineUserID string, messages interface{}, options []model.Option, replyToken string) {
+	lineMessages := toLineMessages(messages)
 	if len(lineMessages) == 0 {
 		return
 	}
 
-	_, err := s.bot.ReplyMessage(&messaging_api.ReplyMessageRequest{
-		ReplyToken: replyToken,
-		Messages:   lineMessages,
-	})
-	if err != nil {
-		log.Printf("Error replying message: %v", err)
+	if qr := quickReplyFromOptions(options); qr != nil {
+		switch last := lineMessages[len(lineMessages)-1].(type) {
+		case *messaging_api.TextMessage:
+			last.QuickReply = qr
+		case *messaging_api.ImageMessage:
+			last.QuickReply = qr
+		case *messaging_api.FlexMessage:
+			last.QuickReply = qr
+		}
 	}
+
+	s.replyMessages(lineUserID, lineMessages, replyToken)
 }
 
 // ReplyImage sends an image reply.
 func (s *SendService) ReplyImage(imageURL, replyToken string) {
-	if s.bot == nil {
-		return
-	}
-
-	_, err := s.bot.ReplyMessage(&messaging_api.ReplyMessageRequest{
-		ReplyToken: replyToken,
-		Messages: []messaging_api.MessageInterface{
-			&messaging_api.ImageMessage{
-				OriginalContentUrl: imageURL,
-				PreviewImageUrl:    imageURL,
-			},
+	s.reply("", []messaging_api.MessageInterface{
+		&messaging_api.ImageMessage{
+			OriginalContentUrl: imageURL,
+			PreviewImageUrl:    imageURL,
 		},
-	})
-	if err != nil {
-		log.Printf("Error replying image: %v", err)
-	}
+	}, replyToken)
 }
 
 // ReplyImageAndMessages sends mixed image and text messages.
 func (s *SendService) ReplyImageAndMessages(contents []map[string]string, replyToken string) {
-	if s.bot == nil {
-		return
+	s.Reply(contents, replyToken)
+}
+
+// ShowLoading shows the loading animation in the user's chat for about the
+// expected duration. It disappears as soon as the reply arrives.
+func (s *SendService) ShowLoading(lineUserID string, expected time.Duration) {
+	seconds := int((expected + time.Second - 1) / time.Second)
+	// LINE は5秒刻みのみ受け付ける
+	seconds = (seconds + loadingSecondsStep - 1) / loadingSecondsStep * loadingSecondsStep
+	seconds = min(max(seconds, minLoadingSeconds), maxLoadingSeconds)
+	if err := s.messenger.ShowLoading(lineUserID, seconds); err != nil {
+		log.Printf("Error showing loading animation to %s: %v", lineUserID, err)
 	}
+}
 
-	var lineMessages []messaging_api.MessageInterface
-	for _, content := range contents {
-		switch content["type"] {
-		case "image":
-			lineMessages = append(lineMessages, &messaging_api.ImageMessage{
-				OriginalContentUrl: content["content"],
-				PreviewImageUrl:    content["content"],
-			})
-		case "text":
-			lineMessages = append(lineMessages, &messaging_api.TextMessage{Text: content["content"]})
+// Broadcast sends a message to all users.
+func (s *SendService) Broadcast(message string) delivery.Result {
+	return s.broadcast(message, delivery.NewRetryKey())
+}
+
+func (s *SendService) broadcast(message, retryKey string) delivery.Result {
+	result := s.messenger.Broadcast(pushMessages(message), retryKey)
+	if result.Err != nil {
+		log.Printf("Error broadcasting message: %v", result.Err)
+	}
+	return result
+}
+
+// Multicast sends a message to the given users, split into requests of at
+// most maxMulticastRecipients. Up to LINE_MULTICAST_CONCURRENCY (default 4)
+// requests run at once. A failed request fails only its own recipients.
+func (s *SendService) Multicast(message string, lineUserIDs []string) *delivery.Report {
+	var chunks [][]string
+	for i := 0; i < len(lineUserIDs); i += maxMulticastRecipients {
+		end := i + maxMulticastRecipients
+		if end > len(lineUserIDs) {
+			end = len(lineUserIDs)
 		}
+		chunks = append(chunks, lineUserIDs[i:end])
 	}
 
-	_, err := s.bot.ReplyMessage(&messaging_api.ReplyMessageRequest{
-		ReplyToken: replyToken,
-		Messages:   lineMessages,
-	})
-	if err != nil {
-		log.Printf("Error replying image and messages: %v", err)
+	results := make([][]delivery.Result, len(chunks))
+	sem := make(chan struct{}, getEnvInt("LINE_MULTICAST_CONCURRENCY", 4))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chunk []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.multicast(message, chunk, delivery.NewRetryKey())
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	report := &delivery.Report{}
+	for _, rs := range results {
+		for _, r := range rs {
+			report.Add(r)
+		}
 	}
+	return report
 }
 
-// Broadcast sends a message to all users.
-func (s *SendService) Broadcast(message string) {
-	if s.bot == nil {
-		return
+// multicast sends one multicast request and returns a result per recipient.
+func (s *SendService) multicast(message string, lineUserIDs []string, retryKey string) []delivery.Result {
+	result := s.messenger.Multicast(lineUserIDs, pushMessages(message), retryKey)
+	if result.Err != nil {
+		log.Printf("Error multicasting message to %d users: %v", len(lineUserIDs), result.Err)
 	}
 
-	_, err := s.bot.Broadcast(&messaging_api.BroadcastRequest{
-		Messages: []messaging_api.MessageInterface{
-			&messaging_api.TextMessage{Text: message},
-		},
-	}, "")
-	if err != nil {
-		log.Printf("Error broadcasting message: %v", err)
+	results := make([]delivery.Result, len(lineUserIDs))
+	for i, id := range lineUserIDs {
+		results[i] = result
+		results[i].To = id
 	}
+	return results
 }
 
-// BroadcastToShik sends a message to shik users via push.
-func (s *SendService) BroadcastToShik(message string, lineUserIDs []string) {
-	for _, id := range lineUserIDs {
-		s.Unicast(id, message)
+// Unicast sends a message to a specific user.
+func (s *SendService) Unicast(lineUserID, message string) delivery.Result {
+	return s.unicast(lineUserID, message, delivery.NewRetryKey())
+}
+
+func (s *SendService) unicast(lineUserID, message, retryKey string) delivery.Result {
+	result := s.messenger.Push(lineUserID, pushMessages(message), retryKey)
+	if result.Err != nil {
+		log.Printf("Error sending unicast message to %s: %v", lineUserID, result.Err)
 	}
+	return result
 }
 
-// Unicast sends a message to a specific user.
-func (s *SendService) Unicast(lineUserID, message string) {
-	if s.bot == nil {
-		return
+// recordFailures saves the failed sends of a report under the group ID so
+// they can be resent later with ResendFailures.
+func recordFailures(groupID, message string, results ...delivery.Result) {
+	for _, r := range results {
+		if r.OK() {
+			continue
+		}
+		f := &model.SendFailure{
+			GroupID:    groupID,
+			Kind:       r.Kind,
+			LineUserID: r.To,
+			Message:    message,
+			RetryKey:   r.RetryKey,
+			StatusCode: r.StatusCode,
+			Error:      r.Err.Error(),
+		}
+		if err := model.CreateSendFailure(f); err != nil {
+			log.Printf("Error recording send failure for %s: %v", r.To, err)
+		}
 	}
+}
 
-	_, err := s.bot.PushMessage(&messaging_api.PushMessageRequest{
-		To: lineUserID,
-		Messages: []messaging_api.MessageInterface{
-			&messaging_api.TextMessage{Text: message},
-		},
-	}, "")
+// ResendFailures queues the messages of the group that LINE did not accept
+// to the outbox, to just the recipients that missed them, and returns how
+// many recipients were queued. Each failed request is repeated as it was
+// sent, with its original retry key, so a message LINE accepted after all is
+// not delivered twice. notifyLineUserID, when set, is told if a resend
+// fails again.
+func ResendFailures(groupID, notifyLineUserID string) (int, error) {
+	failures, err := model.GetPendingSendFailures(groupID)
 	if err != nil {
-		log.Printf("Error sending unicast message: %v", err)
+		return 0, err
 	}
-}
 
-// splitMessage splits a message into chunks of the given max size.
-func splitMessage(msg string, maxLen int) []string {
-	if len([]rune(msg)) <= maxLen {
-		return []string{msg}
+	// 同じマルチキャストで失敗した宛先はまとめて送り直す
+	var order []string
+	byRequest := map[string][]*model.SendFailure{}
+	for i := range failures {
+		f := &failures[i]
+		if _, ok := byRequest[f.RetryKey]; !ok {
+			order = append(order, f.RetryKey)
+		}
+		byRequest[f.RetryKey] = append(byRequest[f.RetryKey], f)
 	}
 
-	var chunks []string
-	runes := []rune(msg)
-	for i := 0; i < len(runes); i += maxLen {
-		end := i + maxLen
-		if end > len(runes) {
-			end = len(runes)
+	var msgs []*model.OutboxMessage
+	var queued []model.SendFailure
+	for _, key := range order {
+		fs := byRequest[key]
+		message, err := fs[0].PlainMessage()
+		if err != nil {
+			log.Printf("Error decrypting send failure %d: %v", fs[0].ID, err)
+			continue
+		}
+		var ids []string
+		if fs[0].Kind != delivery.KindBroadcast {
+			for _, f := range fs {
+				ids = append(ids, f.LineUserID)
+			}
+		}
+		m := model.NewOutboxResend(groupID, fs[0].Kind, ids, message, key)
+		m.NotifyLineUserID = notifyLineUserID
+		msgs = append(msgs, m)
+		for _, f := range fs {
+			queued = append(queued, *f)
 		}
-		chunks = append(chunks, string(runes[i:end]))
 	}
-	return chunks
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	if err := model.QueueSendFailureResends(msgs, queued); err != nil {
+		return 0, err
+	}
+	return len(queued), nil
+}
+
+// FitsInPush reports whether the message renders to no more messages than
+// LINE accepts in one push, multicast or broadcast request.
+func (s *SendService) FitsInPush(message string) bool {
+	return len(pushMessages(message)) <= maxPushMessages
+}
+
+// PushMessageCount returns how many LINE messages each recipient gets for
+// the message.
+func PushMessageCount(message string) int {
+	return len(pushMessages(message))
+}
+
+// pushMessages renders a message for broadcast, multicast and push. Every
+// send path uses it, so a test send shows exactly what recipients will get.
+func pushMessages(message string) []messaging_api.MessageInterface {
+	return toLineMessages(message)
+}
+
+// toLineMessages converts reply content into LINE messages.
+// Supports string, []string, []map[string]string ({"type": "text"|"image", "content": ...})
+// and *view.List.
+func toLineMessages(messages interface{}) []messaging_api.MessageInterface {
+	var lineMessages []messaging_api.MessageInterface
+
+	switch v := messages.(type) {
+	case *view.List:
+		return listMessages(v)
+	case string:
+		lineMessages = textMessages(v)
+	case []string:
+		for _, msg := range v {
+			lineMessages = append(lineMessages, textMessages(msg)...)
+		}
+	case []map[string]string:
+		for _, content := range v {
+			switch content["type"] {
+			case "image":
+				lineMessages = append(lineMessages, &messaging_api.ImageMessage{
+					OriginalContentUrl: content["content"],
+					PreviewImageUrl:    content["content"],
+				})
+			case "text":
+				lineMessages = append(lineMessages, textMessages(content["content"])...)
+			}
+		}
+	}
+	return lineMessages
+}
+
+// textMessages splits text into as many text bubbles as it needs.
+func textMessages(text string) []messaging_api.MessageInterface {
+	var messages []messaging_api.MessageInterface
+	for _, chunk := range splitMessage(text, maxTextLength) {
+		messages = append(messages, &messaging_api.TextMessage{Text: chunk})
+	}
+	return messages
+}
+
+// quickReplyFromOptions builds quick-reply postback buttons for message options.
+// Returns nil when there are no options or more than LINE allows.
+func quickReplyFromOptions(options []model.Option) *messaging_api.QuickReply {
+	if len(options) == 0 || len(options) > maxQuickReplyItems {
+		return nil
+	}
+
+	var items []messaging_api.QuickReplyItem
+	for _, o := range options {
+		text := fmt.Sprintf("%d: %s", o.Position, o.GetContent())
+		items = append(items, messaging_api.QuickReplyItem{
+			Action: &messaging_api.PostbackAction{
+				Label:       truncateRunes(text, maxQuickReplyLabel),
+				Data:        OptionPostbackData(o.Position),
+				DisplayText: truncateRunes(text, maxPostbackDisplayText),
+			},
+		})
+	}
+	return &messaging_api.QuickReply{Items: items}
+}
+
+// OptionPostbackData returns the postback data that selects the option at the given position.
+func OptionPostbackData(position int) string {
+	return OptionPostbackKey + "=" + strconv.Itoa(position)
+}
+
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
 }
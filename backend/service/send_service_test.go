@@ -0,0 +1,170 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/RyokouKanai/gomethod/delivery"
+	"github.com/RyokouKanai/gomethod/model"
+)
+
+// recordFallbacks captures reply fallbacks instead of writing them to the DB.
+func recordFallbacks(t *testing.T) *[]*model.ReplyFallback {
+	t.Helper()
+	var recorded []*model.ReplyFallback
+	orig := recordReplyFallback
+	recordReplyFallback = func(f *model.ReplyFallback) error {
+		recorded = append(recorded, f)
+		return nil
+	}
+	t.Cleanup(func() { recordReplyFallback = orig })
+	return &recorded
+}
+
+func numbered(n int) []string {
+	texts := make([]string, n)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("message %d", i+1)
+	}
+	return texts
+}
+
+func TestReplyTo(t *testing.T) {
+	m := NewRecordingMessenger()
+	NewSendServiceWith(m).ReplyTo("U1", numbered(2), "token")
+
+	sent := m.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("got %d requests, want 1", len(sent))
+	}
+	if sent[0].Kind != KindReply || sent[0].ReplyToken != "token" {
+		t.Errorf("got %s with token %q, want a reply with token %q", sent[0].Kind, sent[0].ReplyToken, "token")
+	}
+	if got, want := sent[0].Texts(), numbered(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("texts = %q, want %q", got, want)
+	}
+}
+
+func TestReplyOverflowIsPushedInOrder(t *testing.T) {
+	t.Setenv("LINE_REPLY_OVERFLOW", ReplyOverflowPush)
+	m := NewRecordingMessenger()
+	NewSendServiceWith(m).ReplyWithOptionsTo("U1", numbered(12), nil, "token")
+
+	sent := m.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("got %d requests, want a reply and two pushes", len(sent))
+	}
+	var texts []string
+	for i, s := range sent {
+		wantKind := delivery.KindPush
+		if i == 0 {
+			wantKind = KindReply
+		}
+		if s.Kind != wantKind {
+			t.Errorf("request %d is %s, want %s", i, s.Kind, wantKind)
+		}
+		if len(s.Messages) > maxReplyMessages {
+			t.Errorf("request %d has %d messages, over LINE's %d", i, len(s.Messages), maxReplyMessages)
+		}
+		if s.Kind == delivery.KindPush && !reflect.DeepEqual(s.To, []string{"U1"}) {
+			t.Errorf("request %d pushed to %q, want U1", i, s.To)
+		}
+		texts = append(texts, s.Texts()...)
+	}
+	if want := numbered(12); !reflect.DeepEqual(texts, want) {
+		t.Errorf("texts = %q, want %q", texts, want)
+	}
+}
+
+func TestReplyOverflowWithoutUserIsDropped(t *testing.T) {
+	t.Setenv("LINE_REPLY_OVERFLOW", ReplyOverflowPush)
+	m := NewRecordingMessenger()
+	NewSendServiceWith(m).Reply(numbered(7), "token")
+
+	sent := m.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("got %d requests, want 1", len(sent))
+	}
+	if got, want := sent[0].Texts(), numbered(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("texts = %q, want %q", got, want)
+	}
+}
+
+func TestReplyFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		lineUserID string
+		fallback   string
+		wantPushed bool
+		wantResult string
+	}{
+		{name: "pushed", lineUserID: "U1", wantPushed: true, wantResult: model.ReplyFallbackPushed},
+		{name: "disabled", lineUserID: "U1", fallback: "off", wantResult: model.ReplyFallbackDisabled},
+		{name: "no user", lineUserID: "", wantResult: model.ReplyFallbackNoUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REPLY_FALLBACK", tt.fallback)
+			fallbacks := recordFallbacks(t)
+			m := NewRecordingMessenger()
+			m.Fail = func(s SentMessage) error {
+				if s.Kind == KindReply {
+					return fmt.Errorf("reply: %w", ErrInvalidReplyToken)
+				}
+				return nil
+			}
+			NewSendServiceWith(m).ReplyTo(tt.lineUserID, numbered(2), "expired")
+
+			sent := m.Sent()
+			if !tt.wantPushed {
+				if len(sent) != 0 {
+					t.Errorf("got %d requests, want none", len(sent))
+				}
+			} else {
+				if len(sent) != 1 || sent[0].Kind != delivery.KindPush {
+					t.Fatalf("got %+v, want one push", sent)
+				}
+				if !reflect.DeepEqual(sent[0].To, []string{tt.lineUserID}) {
+					t.Errorf("pushed to %q, want %s", sent[0].To, tt.lineUserID)
+				}
+				if got, want := sent[0].Texts(), numbered(2); !reflect.DeepEqual(got, want) {
+					t.Errorf("texts = %q, want %q", got, want)
+				}
+			}
+
+			if len(*fallbacks) != 1 {
+				t.Fatalf("recorded %d fallbacks, want 1", len(*fallbacks))
+			}
+			f := (*fallbacks)[0]
+			if f.Outcome != tt.wantResult || f.MessageCount != 2 {
+				t.Errorf("fallback = %s with %d messages, want %s with 2", f.Outcome, f.MessageCount, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestReplyOverflowFallsBackToPush(t *testing.T) {
+	t.Setenv("LINE_REPLY_OVERFLOW", ReplyOverflowPush)
+	t.Setenv("REPLY_FALLBACK", "")
+	recordFallbacks(t)
+	m := NewRecordingMessenger()
+	m.Fail = func(s SentMessage) error {
+		if s.Kind == KindReply {
+			return ErrInvalidReplyToken
+		}
+		return nil
+	}
+	NewSendServiceWith(m).ReplyTo("U1", numbered(7), "expired")
+
+	var texts []string
+	for _, s := range m.Sent() {
+		if s.Kind != delivery.KindPush {
+			t.Errorf("got a %s request, want only pushes", s.Kind)
+		}
+		texts = append(texts, s.Texts()...)
+	}
+	if want := numbered(7); !reflect.DeepEqual(texts, want) {
+		t.Errorf("texts = %q, want %q", texts, want)
+	}
+}
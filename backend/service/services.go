@@ -1,6 +1,8 @@
 package service
 
 import (
+	"errors"
+
 	"github.com/RyokouKanai/gomethod/model"
 )
 
@@ -21,6 +23,13 @@ func newBaseService(user *model.User, receivedMessage, replyToken string, ss *Se
 	}
 }
 
+// reply sends content in response to the received message, offering the
+// options of the message the user is now looking at as quick replies.
+func (bs *BaseService) reply(content interface{}, message *model.Message) {
+	options, _ := message.GetOptions()
+	bs.sendService.ReplyWithOptionsTo(bs.User.LineUserID, content, options, bs.ReplyToken)
+}
+
 func (bs *BaseService) createTalkHistory(message *model.Message) (*model.TalkHistory, error) {
 	return bs.User.CreateTalkHistory(message)
 }
@@ -47,7 +56,7 @@ func (s *AvailableService) execute() bool {
 	if unavailableMsg == nil {
 		return false
 	}
-	s.sendService.Reply(unavailableMsg.ToFormattedText(), s.ReplyToken)
+	s.reply(unavailableMsg.ToFormattedText(), unavailableMsg)
 	s.createTalkHistory(unavailableMsg)
 	return true
 }
@@ -85,7 +94,7 @@ func (s *ThanksCountService) execute() bool {
 			}
 		}
 
-		s.sendService.Reply(message, s.ReplyToken)
+		s.sendService.ReplyTo(s.User.LineUserID, message, s.ReplyToken)
 	}
 	return true
 }
@@ -112,7 +121,7 @@ func (s *TopBackService) execute() bool {
 	if topMsg == nil {
 		return false
 	}
-	s.sendService.Reply(topMsg.ToFormattedText(), s.ReplyToken)
+	s.reply(topMsg.ToFormattedText(), topMsg)
 	s.createTalkHistory(topMsg)
 	return true
 }
@@ -139,11 +148,45 @@ func (s *TopMessageSendService) execute() bool {
 	if topMsg == nil {
 		return false
 	}
-	s.sendService.Reply(topMsg.ToFormattedText(), s.ReplyToken)
+	s.reply(topMsg.ToFormattedText(), topMsg)
 	s.createTalkHistory(topMsg)
 	return true
 }
 
+// unsupportedInputText is sent when the user sends a message type the current step can't handle.
+const unsupportedInputText = "ごめんなさい、この形式のメッセージはまだ読めません。\nテキストで送ってください。"
+
+// UnsupportedInputService answers non-text messages that no reply pattern
+// accepts, without moving the user away from the current step.
+type UnsupportedInputService struct {
+	BaseService
+	inputType string
+}
+
+func NewUnsupportedInputService(user *model.User, inputType, token string, ss *SendService) *UnsupportedInputService {
+	return &UnsupportedInputService{BaseService: newBaseService(user, "", token, ss), inputType: inputType}
+}
+
+func (s *UnsupportedInputService) Executed() bool {
+	return s.inputType != model.InputTypeText && s.execute()
+}
+
+func (s *UnsupportedInputService) Execute() {
+	s.execute()
+}
+
+func (s *UnsupportedInputService) execute() bool {
+	// 直前のメッセージの選択肢をクイックリプライで出し直す
+	if th, err := s.User.GetLatestTalkHistory(); err == nil && th != nil {
+		if lastMsg := th.GetMessage(); lastMsg != nil {
+			s.reply(unsupportedInputText, lastMsg)
+			return true
+		}
+	}
+	s.sendService.ReplyTo(s.User.LineUserID, unsupportedInputText, s.ReplyToken)
+	return true
+}
+
 // AdminLoginService handles admin login via LINE.
 type AdminLoginService struct {
 	BaseService
@@ -166,11 +209,50 @@ func (s *AdminLoginService) execute() bool {
 	if adminMsg == nil {
 		return false
 	}
-	s.sendService.Reply(adminMsg.ToFormattedText(), s.ReplyToken)
+	s.reply(adminMsg.ToFormattedText(), adminMsg)
 	s.createTalkHistory(adminMsg)
 	return true
 }
 
+// BroadcastResendService resends an admin's last broadcast to the users it
+// failed to reach, when the admin sends "再送信".
+type BroadcastResendService struct {
+	BaseService
+}
+
+func NewBroadcastResendService(user *model.User, msg, token string, ss *SendService) *BroadcastResendService {
+	return &BroadcastResendService{BaseService: newBaseService(user, msg, token, ss)}
+}
+
+func (s *BroadcastResendService) Executed() bool {
+	return s.ReceivedMessage == "再送信" && s.User.IsAdmin() && s.execute()
+}
+
+func (s *BroadcastResendService) Execute() {
+	s.execute()
+}
+
+func (s *BroadcastResendService) execute() bool {
+	groupID := model.FindLatestPendingSendFailureGroup(model.BroadcastFailureGroupPrefix(s.User.ID))
+	if groupID == "" {
+		s.sendService.ReplyTo(s.User.LineUserID, "再送信が必要な配信はありません", s.ReplyToken)
+		return true
+	}
+
+	// 再送信も失敗したら配信と同じく管理者に通知する
+	queued, err := ResendFailures(groupID, s.User.LineUserID)
+	if errors.Is(err, model.ErrSendFailureResent) {
+		s.sendService.ReplyTo(s.User.LineUserID, "再送信はすでに受け付けています", s.ReplyToken)
+		return true
+	}
+	if err != nil {
+		s.sendService.ReplyTo(s.User.LineUserID, "再送信に失敗しました", s.ReplyToken)
+		return true
+	}
+	s.sendService.ReplyTo(s.User.LineUserID, itoa(queued)+"件を再送信します", s.ReplyToken)
+	return true
+}
+
 func itoa(n int) string {
 	if n == 0 {
 		return "0"
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxTextLength is how long one text bubble may get. LINE allows 5000
+// characters counted in UTF-16 code units; the margin leaves room for edits.
+const maxTextLength = 4500
+
+// splitMessage splits a message into bubbles of at most maxLen UTF-16 code
+// units. It breaks at the last paragraph, line, sentence or word boundary in
+// the second half of the bubble, in that order of preference, and otherwise
+// between two characters, never inside a surrogate pair or an emoji sequence.
+// A single character longer than maxLen gets a bubble of its own.
+func splitMessage(msg string, maxLen int) []string {
+	var chunks []string
+	for utf16Len(msg) > maxLen {
+		cut := splitPoint(msg, maxLen)
+		chunk := strings.TrimRight(msg[:cut], "\n")
+		if chunk == "" {
+			chunk = msg[:cut]
+		}
+		chunks = append(chunks, chunk)
+		msg = strings.TrimLeft(msg[cut:], "\n")
+	}
+	if msg != "" || len(chunks) == 0 {
+		chunks = append(chunks, msg)
+	}
+	return chunks
+}
+
+// splitPoint returns the byte offset to cut msg at so the first part fits in
+// maxLen UTF-16 code units.
+func splitPoint(msg string, maxLen int) int {
+	var paragraph, line, sentence, word, char int
+	units := 0
+	var prev rune
+	riRun := 0 // 直前に続く地域指示子の数（国旗は2つで1文字）
+	for i, r := range msg {
+		if i > 0 && canBreak(prev, r, riRun) {
+			if units*2 >= maxLen {
+				switch {
+				case prev == '\n' && strings.HasSuffix(msg[:i], "\n\n"):
+					paragraph = i
+				case prev == '\n':
+					line = i
+				case strings.ContainsRune("。！？!?.", prev):
+					sentence = i
+				case prev == ' ' || prev == '\u3000':
+					word = i
+				}
+			}
+			char = i
+		}
+		units += utf16.RuneLen(r)
+		if units > maxLen {
+			break
+		}
+		if isRegionalIndicator(r) {
+			riRun++
+		} else {
+			riRun = 0
+		}
+		prev = r
+	}
+	for _, cut := range []int{paragraph, line, sentence, word, char} {
+		if cut > 0 {
+			return cut
+		}
+	}
+	// 1文字だけで上限を超える場合もその文字は切らない
+	return firstGraphemeEnd(msg)
+}
+
+// firstGraphemeEnd returns the byte offset where msg's first character ends.
+func firstGraphemeEnd(msg string) int {
+	prev, size := utf8.DecodeRuneInString(msg)
+	riRun := 0
+	for i, r := range msg[size:] {
+		if isRegionalIndicator(prev) {
+			riRun++
+		} else {
+			riRun = 0
+		}
+		if canBreak(prev, r, riRun) {
+			return size + i
+		}
+		prev = r
+	}
+	return len(msg)
+}
+
+// canBreak reports whether a bubble may end between prev and r without
+// splitting a character the user sees as one.
+func canBreak(prev, r rune, riRun int) bool {
+	switch {
+	case prev == '\r' && r == '\n':
+		return false
+	case prev == '\u200d': // ZWJ で繋がった絵文字
+		return false
+	case isRegionalIndicator(r) && riRun%2 == 1:
+		return false
+	case isExtender(r):
+		return false
+	}
+	return true
+}
+
+// isExtender reports whether r attaches to the character before it.
+func isExtender(r rune) bool {
+	switch {
+	case r == '\u200d', r == '\u20e3': // ZWJ, keycap
+		return true
+	case r >= '\ufe00' && r <= '\ufe0f': // variation selectors
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff: // skin tone modifiers
+		return true
+	case r >= 0xe0020 && r <= 0xe007f: // tag sequences
+		return true
+	case r >= 0xe0100 && r <= 0xe01ef:
+		return true
+	}
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// utf16Len returns the length of s as LINE counts it.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	family := "\U0001F468\u200d\U0001F469\u200d\U0001F467" // ZWJ で繋がった1文字（UTF-16 で8単位）
+	tests := []struct {
+		name   string
+		msg    string
+		maxLen int
+		want   []string
+	}{
+		{name: "short", msg: "こんにちは", maxLen: 10, want: []string{"こんにちは"}},
+		{name: "empty", msg: "", maxLen: 10, want: []string{""}},
+		{name: "paragraph", msg: "一行目\n二行目\n\n三行目", maxLen: 10, want: []string{"一行目\n二行目", "三行目"}},
+		{name: "line", msg: "aaaa\nbbbb\ncccc", maxLen: 10, want: []string{"aaaa\nbbbb", "cccc"}},
+		{name: "sentence", msg: "今日は晴れ。明日は雨です", maxLen: 8, want: []string{"今日は晴れ。", "明日は雨です"}},
+		{name: "word", msg: "one two three", maxLen: 9, want: []string{"one two ", "three"}},
+		{name: "no boundary", msg: "abcdefghij", maxLen: 4, want: []string{"abcd", "efgh", "ij"}},
+		{name: "surrogate pair", msg: "a\U0001F600\U0001F600", maxLen: 4, want: []string{"a\U0001F600", "\U0001F600"}},
+		{name: "emoji sequence", msg: "ab" + family, maxLen: 8, want: []string{"ab", family}},
+		{name: "flags", msg: "\U0001F1EF\U0001F1F5\U0001F1FA\U0001F1F8", maxLen: 6, want: []string{"\U0001F1EF\U0001F1F5", "\U0001F1FA\U0001F1F8"}},
+		{name: "character over limit", msg: family + "a", maxLen: 4, want: []string{family, "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.msg, tt.maxLen)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMessage(%q, %d) = %q, want %q", tt.msg, tt.maxLen, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessageKeepsText(t *testing.T) {
+	msg := strings.Repeat("あいうえお、かきくけこ。\U0001F600 sashisuseso\n", 800)
+	chunks := splitMessage(msg, maxTextLength)
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want the message split", len(chunks))
+	}
+	for i, c := range chunks {
+		if n := utf16Len(c); n > maxTextLength {
+			t.Errorf("chunk %d is %d UTF-16 units, over %d", i, n, maxTextLength)
+		}
+		if !utf8.ValidString(c) {
+			t.Errorf("chunk %d is not valid UTF-8", i)
+		}
+	}
+	// 改行で区切られるので、改行で繋ぎ直せば元に戻る
+	if got := strings.Join(chunks, "\n"); got != msg {
+		t.Errorf("joined chunks differ from the message")
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// GCSStore uploads blobs to a Google Cloud Storage bucket through the JSON API.
+// Credentials come from the Cloud Run metadata server. GCS_ENDPOINT can point
+// at an emulator (e.g. fake-gcs-server), in which case no token is requested.
+// The bucket is private; objects are read back through Open.
+type GCSStore struct {
+	Bucket   string
+	Endpoint string
+	client   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	tokenExp  time.Time
+	useTokens bool
+}
+
+// NewGCSStore creates a GCSStore for the given bucket.
+func NewGCSStore(bucket string) *GCSStore {
+	endpoint := os.Getenv("GCS_ENDPOINT")
+	useTokens := endpoint == ""
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	return &GCSStore{
+		Bucket:    bucket,
+		Endpoint:  endpoint,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		useTokens: useTokens,
+	}
+}
+
+// Put uploads the blob as gs://Bucket/key.
+func (s *GCSStore) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		s.Endpoint, url.PathEscape(s.Bucket), url.QueryEscape(key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, r)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("gcs upload failed: %d, %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Open downloads gs://Bucket/key.
+func (s *GCSStore) Open(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media",
+		s.Endpoint, url.PathEscape(s.Bucket), url.PathEscape(key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, "", ErrNotFound
+	case resp.StatusCode/100 != 2:
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("gcs download failed: %d, %s", resp.StatusCode, string(body))
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// do sends the request with the service account's token.
+func (s *GCSStore) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if s.useTokens {
+		token, err := s.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return s.client.Do(req)
+}
+
+func (s *GCSStore) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.tokenExp) {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata token request failed: %d", resp.StatusCode)
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	s.token = t.AccessToken
+	// 期限ぎりぎりのトークンを使わないよう 1 分早めに更新する
+	s.tokenExp = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - time.Minute)
+	return s.token, nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// LocalStore keeps blobs on the local filesystem. Intended for development.
+type LocalStore struct {
+	Dir string
+}
+
+// NewLocalStore creates a LocalStore rooted at dir.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{Dir: dir}
+}
+
+// Put writes the blob to Dir/key.
+func (s *LocalStore) Put(_ context.Context, key, _ string, r io.Reader) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// Open opens Dir/key; the content type comes from the extension.
+func (s *LocalStore) Open(_ context.Context, key string) (io.ReadCloser, string, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return f, mime.TypeByExtension(path.Ext(key)), nil
+}
+
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(path.Clean("/"+key)))
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refPrefix marks a stored value as a blob key rather than a URL.
+const refPrefix = "blob:"
+
+// Ref returns the value to store in the database for the blob key. It is
+// turned into a URL only when the blob is shown, by URL.
+func Ref(key string) string {
+	return refPrefix + key
+}
+
+// UserKeyPrefix is the prefix of the keys of content the user sent.
+func UserKeyPrefix(userID uint) string {
+	return "users/" + strconv.FormatUint(uint64(userID), 10) + "/"
+}
+
+// KeyOf returns the blob key of a value made by Ref.
+func KeyOf(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, refPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(ref, refPrefix), true
+}
+
+// URL returns a short-lived signed URL for a value made by Ref, served by
+// the app under BLOB_BASE_URL. Other values (URLs saved before blobs became
+// private) are returned as they are.
+//
+//	BLOB_BASE_URL:         public URL of the /blobs route (default /blobs)
+//	BLOB_URL_TTL_MINUTES:  how long the URL works (default 60)
+func URL(ref string) string {
+	key, ok := KeyOf(ref)
+	if !ok {
+		return ref
+	}
+	expires := time.Now().Add(urlTTL()).Unix()
+	base := strings.TrimRight(getEnv("BLOB_BASE_URL", "/blobs"), "/")
+	return base + "/" + escapeKey(key) +
+		"?expires=" + strconv.FormatInt(expires, 10) + "&sig=" + sign(key, expires)
+}
+
+// VerifySignature reports whether sig was made by URL for the key and has
+// not expired.
+func VerifySignature(key, expires, sig string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(sign(key, exp)), []byte(sig))
+}
+
+func urlTTL() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("BLOB_URL_TTL_MINUTES")); err == nil && n > 0 {
+		return time.Duration(n) * time.Minute
+	}
+	return time.Hour
+}
+
+func sign(key string, expires int64) string {
+	mac := hmac.New(sha256.New, urlSecret())
+	mac.Write([]byte(key + "|" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	secret     []byte
+	secretOnce sync.Once
+)
+
+// urlSecret returns BLOB_URL_SECRET. Without it a random secret is used, so
+// URLs only work on the instance that made them.
+func urlSecret() []byte {
+	secretOnce.Do(func() {
+		if s := os.Getenv("BLOB_URL_SECRET"); s != "" {
+			secret = []byte(s)
+			return
+		}
+		log.Printf("BLOB_URL_SECRET is not set, blob URLs are signed with a per-process secret")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Error generating blob URL secret: %v", err)
+		}
+	})
+	return secret
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// BlobStore saves binary objects (user images, audio, ...). Objects are
+// private: LINE clients fetch them through the app with a signed URL (see URL).
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, r io.Reader) error
+	// Open returns the object and its content type.
+	Open(ctx context.Context, key string) (io.ReadCloser, string, error)
+}
+
+// ErrNotFound is returned by Open when the object does not exist.
+var ErrNotFound = errors.New("blob not found")
+
+var (
+	defaultStore BlobStore
+	defaultOnce  sync.Once
+)
+
+// Default returns the blob store configured by environment variables.
+//
+//	BLOB_STORE=local (default): files under BLOB_LOCAL_DIR
+//	BLOB_STORE=gcs:             objects in GCS_BUCKET
+func Default() BlobStore {
+	defaultOnce.Do(func() {
+		switch os.Getenv("BLOB_STORE") {
+		case "gcs":
+			defaultStore = NewGCSStore(os.Getenv("GCS_BUCKET"))
+		default:
+			defaultStore = NewLocalStore(getEnv("BLOB_LOCAL_DIR", "tmp/blobs"))
+		}
+		log.Printf("Blob store: %T", defaultStore)
+	})
+	return defaultStore
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
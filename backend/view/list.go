@@ -0,0 +1,77 @@
+// Package view describes structured reply content that the send layer can
+// render richly (LINE Flex Messages) or as plain text.
+package view
+
+import (
+	"fmt"
+	"strings"
+)
+
+// List is a numbered list of items, such as a user's wishes. Actions return
+// it as reply content; SendService renders it as a Flex carousel when
+// enabled and as Text() otherwise.
+type List struct {
+	// Header is the text of the step, shown before the items.
+	Header string
+	Items  []Item
+	// Buttons are shown on every item. Tapping one selects the item and
+	// then the option, as if the user had typed both numbers.
+	Buttons []Button
+	// MessageID is the message the user is at while the list is shown. Item
+	// buttons only work while the user is still there.
+	MessageID uint
+	// Kind names the records listed, e.g. "dream_wishes". With the items'
+	// RecordIDs it lets a button check that its item is still at that number.
+	Kind string
+}
+
+// Item is one entry of a list.
+type Item struct {
+	Number int
+	// RecordID is the ID of the listed record.
+	RecordID uint
+	Date     string
+	Content  string
+	ImageURL string
+	// Notes are extra lines, e.g. "音声: あり".
+	Notes []string
+	// Preview shortens the content in the text rendering to this many runes; 0 shows it all.
+	Preview int
+}
+
+// Button selects an option of the step that follows picking an item.
+type Button struct {
+	Label  string
+	Option int
+}
+
+// Text renders the list as plain text: the header, then one numbered block per item.
+func (l *List) Text() string {
+	blocks := make([]string, 0, len(l.Items))
+	for _, it := range l.Items {
+		blocks = append(blocks, it.Text())
+	}
+	body := strings.Join(blocks, "\n\n")
+	if l.Header == "" {
+		return body
+	}
+	return l.Header + "\n\n" + body
+}
+
+// Text renders the item as a numbered block.
+func (it Item) Text() string {
+	content := it.Content
+	if it.Preview > 0 && len([]rune(content)) > it.Preview {
+		content = string([]rune(content)[:it.Preview]) + "..."
+	}
+	if it.Date == "" && len(it.Notes) == 0 {
+		return fmt.Sprintf("%d:\n%s", it.Number, content)
+	}
+	lines := []string{fmt.Sprintf("%d:", it.Number)}
+	if it.Date != "" {
+		lines = append(lines, "日付: "+it.Date)
+	}
+	lines = append(lines, "内容: "+content)
+	lines = append(lines, it.Notes...)
+	return strings.Join(lines, "\n")
+}
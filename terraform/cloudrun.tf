@@ -28,7 +28,8 @@ resource "google_cloud_run_v2_service" "gomethod" {
       }
 
       resources {
-        cpu_idle = true # リクエスト中のみCPU割当（コスト最適化）
+        # Webhook はレスポンス後にワーカーで処理するため、常時 CPU を割り当てる
+        cpu_idle = false
         limits = {
           cpu    = "1"
           memory = "256Mi"
@@ -83,6 +84,49 @@ resource "google_cloud_run_v2_service" "gomethod" {
           }
         }
       }
+
+      # --- バッチ認証 ---
+      env {
+        name  = "BATCH_OIDC_AUDIENCE"
+        value = local.batch_oidc_audience
+      }
+      env {
+        name  = "BATCH_OIDC_SERVICE_ACCOUNTS"
+        value = google_service_account.scheduler.email
+      }
+      env {
+        name = "BATCH_AUTH_TOKEN"
+        value_source {
+          secret_key_ref {
+            secret  = google_secret_manager_secret.batch_auth_token.secret_id
+            version = "latest"
+          }
+        }
+      }
+
+      # --- ストレージ ---
+      env {
+        name  = "BLOB_STORE"
+        value = "gcs"
+      }
+      env {
+        name  = "GCS_BUCKET"
+        value = google_storage_bucket.blobs.name
+      }
+      env {
+        # サービス自身の URI は参照できない（循環）ため、決まった形式の URL を組み立てる
+        name  = "BLOB_BASE_URL"
+        value = "https://gomethod-${data.google_project.gomethod.number}.asia-northeast1.run.app/blobs"
+      }
+      env {
+        name = "BLOB_URL_SECRET"
+        value_source {
+          secret_key_ref {
+            secret  = google_secret_manager_secret.blob_url_secret.secret_id
+            version = "latest"
+          }
+        }
+      }
     }
 
     # Cloud SQL 接続
@@ -2,12 +2,15 @@
 # Cloud Scheduler
 # ==============================================================================
 #
-# バッチ認証は BATCH_AUTH_TOKEN を Bearer トークンとして送信する。
+# バッチ認証は Google 署名の OIDC トークン（audience = batch_oidc_audience）で行う。
+# アプリ側で署名・audience・発行者・サービスアカウントを検証する。
+# 手動実行などでは BATCH_AUTH_TOKEN を Bearer トークンとして送信してもよい。
 # Cloud Run の URL はデプロイ後に設定する必要がある。
 #
 
 locals {
-  cloud_run_url = google_cloud_run_v2_service.gomethod.uri
+  cloud_run_url       = google_cloud_run_v2_service.gomethod.uri
+  batch_oidc_audience = "gomethod-batch"
 }
 
 # サービスアカウント（Cloud Scheduler → Cloud Run 呼び出し用）
@@ -37,6 +40,7 @@ resource "google_cloud_scheduler_job" "send_moon_message_tomorrow" {
 
     oidc_token {
       service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
     }
   }
 }
@@ -54,6 +58,7 @@ resource "google_cloud_scheduler_job" "send_moon_message_today" {
 
     oidc_token {
       service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
     }
   }
 }
@@ -71,6 +76,7 @@ resource "google_cloud_scheduler_job" "send_daily_g_message" {
 
     oidc_token {
       service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
     }
   }
 }
@@ -88,6 +94,7 @@ resource "google_cloud_scheduler_job" "send_weekly_g_message" {
 
     oidc_token {
       service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
     }
   }
 }
@@ -105,6 +112,7 @@ resource "google_cloud_scheduler_job" "send_weekly_blog_g_message" {
 
     oidc_token {
       service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
     }
   }
 }
@@ -122,6 +130,7 @@ resource "google_cloud_scheduler_job" "send_experience_g_message" {
 
     oidc_token {
       service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
     }
   }
 }
@@ -139,6 +148,61 @@ resource "google_cloud_scheduler_job" "send_notice" {
 
     oidc_token {
       service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
+    }
+  }
+}
+
+# --- 処理済み Webhook イベントの削除 (毎日 04:00 JST) ---
+resource "google_cloud_scheduler_job" "purge_webhook_events" {
+  name      = "purge-webhook-events"
+  region    = "asia-northeast1"
+  schedule  = "0 4 * * *"
+  time_zone = "Asia/Tokyo"
+
+  http_target {
+    http_method = "POST"
+    uri         = "${local.cloud_run_url}/batch/purge_webhook_events"
+
+    oidc_token {
+      service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
+    }
+  }
+}
+
+# --- 予約配信の送信 (5 分ごと) ---
+resource "google_cloud_scheduler_job" "send_scheduled_broadcasts" {
+  name      = "send-scheduled-broadcasts"
+  region    = "asia-northeast1"
+  schedule  = "*/5 * * * *"
+  time_zone = "Asia/Tokyo"
+
+  http_target {
+    http_method = "POST"
+    uri         = "${local.cloud_run_url}/batch/send_scheduled_broadcasts"
+
+    oidc_token {
+      service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
+    }
+  }
+}
+
+# --- リッチメニューの付け替え (毎時) ---
+resource "google_cloud_scheduler_job" "sync_rich_menu_links" {
+  name      = "sync-rich-menu-links"
+  region    = "asia-northeast1"
+  schedule  = "30 * * * *"
+  time_zone = "Asia/Tokyo"
+
+  http_target {
+    http_method = "POST"
+    uri         = "${local.cloud_run_url}/batch/sync_rich_menu_links"
+
+    oidc_token {
+      service_account_email = google_service_account.scheduler.email
+      audience              = local.batch_oidc_audience
     }
   }
 }
@@ -29,3 +29,17 @@ resource "google_secret_manager_secret" "line_channel_secret" {
   }
 }
 
+
+resource "google_secret_manager_secret" "batch_auth_token" {
+  secret_id = "batch_auth_token"
+  replication {
+    auto {}
+  }
+}
+
+resource "google_secret_manager_secret" "blob_url_secret" {
+  secret_id = "blob_url_secret"
+  replication {
+    auto {}
+  }
+}
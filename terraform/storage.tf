@@ -0,0 +1,32 @@
+# ==============================================================================
+# Cloud Storage
+# ==============================================================================
+#
+# ユーザーが送信した画像などを保存するバケット。
+# オブジェクトは非公開。LINE には Cloud Run の /blobs から
+# 期限付きの署名付き URL で配信する（BLOB_URL_SECRET で署名）。
+#
+
+data "google_project" "gomethod" {
+  project_id = "gomethod"
+}
+
+resource "google_storage_bucket" "blobs" {
+  name                        = "gomethod-blobs"
+  location                    = "ASIA-NORTHEAST1"
+  uniform_bucket_level_access = true
+}
+
+# Cloud Run（デフォルトのコンピュート SA）からの書き込み
+resource "google_storage_bucket_iam_member" "blobs_cloud_run_writer" {
+  bucket = google_storage_bucket.blobs.name
+  role   = "roles/storage.objectCreator"
+  member = "serviceAccount:${data.google_project.gomethod.number}-compute@developer.gserviceaccount.com"
+}
+
+# Cloud Run からの読み取り（/blobs で配信するため）
+resource "google_storage_bucket_iam_member" "blobs_cloud_run_reader" {
+  bucket = google_storage_bucket.blobs.name
+  role   = "roles/storage.objectViewer"
+  member = "serviceAccount:${data.google_project.gomethod.number}-compute@developer.gserviceaccount.com"
+}